@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/wheelergeo/g-otter-pkg/token"
+)
+
+// ConditionalPermission is a permission which is granted only when its
+// condition holds over the attributes of the user and of the resource.
+// ABAC needs a second request, policy, effect and matcher in the model:
+//
+//	[request_definition]
+//	r2 = sub, obj, act, user, res
+//
+//	[policy_definition]
+//	p2 = sub, obj, act, cond
+//
+//	[policy_effect]
+//	e2 = some(where (p.eft == allow))
+//
+//	[matchers]
+//	m2 = g(r2.sub, p2.sub) && r2.obj == p2.obj && r2.act == p2.act && eval(p2.cond)
+//
+// so that a condition such as r2.user.Dept == r2.res.Dept lets the users
+// edit the documents of their own department only.
+type ConditionalPermission struct {
+	Obj  string `json:"obj" yaml:"obj"`
+	Act  string `json:"act" yaml:"act"`
+	Cond string `json:"cond" yaml:"cond"`
+}
+
+const abacPtype = "p2"
+
+// MaxFieldLength is the size of the columns of the policy table, a longer
+// condition or object can not be stored.
+const MaxFieldLength = 100
+
+var (
+	ErrABACUnsupported  = errors.New("the model has no r2, p2, e2 and m2 for ABAC")
+	ErrEmptyCondition   = errors.New("the condition must not be empty")
+	ErrConditionTooLong = fmt.Errorf("the condition must not be longer than %d bytes", MaxFieldLength)
+)
+
+var abacContext = casbin.NewEnforceContext("2")
+
+// hasABAC reports whether the model defines the conditional policies, and
+// checks that it defines them the way they are written.
+func hasABAC(m model.Model) (ok bool, err error) {
+	r, hasR := m["r"]["r2"]
+	p, hasP := m["p"]["p2"]
+	if !hasR && !hasP {
+		return
+	}
+
+	if !hasR || !equalTokens(r.Tokens, "r2_sub", "r2_obj", "r2_act", "r2_user", "r2_res") {
+		return false, errors.New(
+			"invalid model: ABAC request must be r2 = sub, obj, act, user, res")
+	}
+	if !hasP || !equalTokens(p.Tokens, "p2_sub", "p2_obj", "p2_act", "p2_cond") {
+		return false, errors.New(
+			"invalid model: ABAC policy must be p2 = sub, obj, act, cond")
+	}
+	if _, ok = m["e"]["e2"]; !ok {
+		return false, errors.New("invalid model: ABAC policy effect e2 is missing")
+	}
+	if _, ok = m["m"]["m2"]; !ok {
+		return false, errors.New("invalid model: ABAC matcher m2 is missing")
+	}
+	return true, nil
+}
+
+func (a *AuthServer) AddConditionalPermissionsForRole(role string,
+	perms []ConditionalPermission) (err error) {
+
+	rules, err := a.roleConditionRules(role, perms)
+	if err != nil {
+		return
+	}
+	return a.commit(addOp("p", abacPtype, rules))
+}
+
+func (a *AuthServer) DeleteConditionalPermissionsForRole(role string,
+	perms []ConditionalPermission) (err error) {
+
+	rules, err := a.roleConditionRules(role, perms)
+	if err != nil {
+		return
+	}
+	return a.commit(removeOp("p", abacPtype, rules))
+}
+
+func (a *AuthServer) GetConditionalPermissionsForRole(role string) (perms []ConditionalPermission) {
+	if !a.withABAC {
+		return
+	}
+	role = a.rolePrefix + role
+
+	policies := a.reader().GetFilteredNamedPolicy(abacPtype, 0, role)
+	if len(policies) == 0 {
+		policies = a.e[0].GetFilteredNamedPolicy(abacPtype, 0, role)
+		if len(policies) != 0 {
+			a.requestSync()
+		}
+	}
+	return a.parseConditions(policies)
+}
+
+// EnforceABAC checks the conditional permissions of the user's roles, res
+// is a struct or a pointer to a struct, whose fields the conditions read.
+func (a *AuthServer) EnforceABAC(user *token.UserContext, obj string,
+	act string, res interface{}) (b bool) {
+
+	if !a.withABAC || user == nil {
+		return
+	}
+	sub := a.userPrefix + strconv.FormatInt(user.Id, 10)
+	obj = a.policyPrefix + obj
+
+	b, err := a.reader().Enforce(abacContext, sub, obj, act, user, res)
+	if err != nil {
+		b, err = a.e[0].Enforce(abacContext, sub, obj, act, user, res)
+	}
+	if err != nil || !(a.health.redisUp() || a.health.dbUp()) {
+		b = a.failMode.decide(b, err)
+	}
+	return
+}
+
+func (a *AuthServer) roleConditionRules(role string,
+	perms []ConditionalPermission) (rules [][]string, err error) {
+
+	if !a.withABAC {
+		return nil, ErrABACUnsupported
+	}
+	for _, v := range perms {
+		if strings.TrimSpace(v.Cond) == "" {
+			return nil, ErrEmptyCondition
+		}
+		if len(v.Cond) > MaxFieldLength {
+			return nil, ErrConditionTooLong
+		}
+		if len(a.policyPrefix+v.Obj) > MaxFieldLength {
+			return nil, ErrObjectTooLong
+		}
+		rules = append(rules, []string{
+			a.rolePrefix + role,
+			a.policyPrefix + v.Obj,
+			v.Act,
+			v.Cond,
+		})
+	}
+	return
+}
+
+func (a *AuthClient) GetConditionalPermissionsForRole(role string) []ConditionalPermission {
+	if !a.withABAC {
+		return nil
+	}
+	return a.parseConditions(
+		a.e.GetFilteredNamedPolicy(abacPtype, 0, a.rolePrefix+role))
+}
+
+// EnforceABAC checks the conditional permissions of the user's roles, the
+// decision cache is not used because the attributes differ every time.
+func (a *AuthClient) EnforceABAC(user *token.UserContext, obj string,
+	act string, res interface{}) (b bool) {
+
+	if !a.withABAC || user == nil {
+		return
+	}
+	sub := a.userPrefix + strconv.FormatInt(user.Id, 10)
+	obj = a.policyPrefix + obj
+
+	b, err := a.e.Enforce(abacContext, sub, obj, act, user, res)
+	if err != nil || !a.health.redisUp() {
+		b = a.failMode.decide(b, err)
+	}
+	return
+}
+
+func (n *naming) parseConditions(rules [][]string) (perms []ConditionalPermission) {
+	for _, v := range rules {
+		if len(v) != 4 || !strings.HasPrefix(v[0], n.rolePrefix) ||
+			!strings.HasPrefix(v[1], n.policyPrefix) {
+			n.malformed(v)
+			continue
+		}
+		perms = append(perms, ConditionalPermission{
+			Obj:  v[1][len(n.policyPrefix):],
+			Act:  v[2],
+			Cond: v[3],
+		})
+	}
+	return
+}
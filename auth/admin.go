@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/utils"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"github.com/cloudwego/hertz/pkg/route"
+	"github.com/wheelergeo/g-otter-pkg/constants"
+	"github.com/wheelergeo/g-otter-pkg/token"
+)
+
+const (
+	DefaultAdminObject = "auth:admin"
+
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// Only for hertz
+type AdminConfig struct {
+	ErrMsg  string
+	ErrCode int
+	// Checked by AuthServer.Enforce before every request, DefaultAdminObject
+	// by default
+	Object string
+}
+
+type rolesRequest struct {
+	Roles []string `json:"roles"`
+	// Grants the roles until then, permanently when it is nil
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type permissionsRequest struct {
+	Permissions []Permission `json:"permissions"`
+}
+
+// RegisterAdminRoutes mounts the management of the roles on the group, the
+// group must use the middleware which parses the token. The changes are
+// audited as made by the signed in user.
+//
+//	GET    /roles                    ?page=1&size=20
+//	DELETE /roles/:role
+//	GET    /roles/:role/users        ?page=1&size=20
+//	GET    /roles/:role/permissions  ?page=1&size=20
+//	POST   /roles/:role/permissions  {"permissions": [{"obj": "", "act": ""}]}
+//	DELETE /roles/:role/permissions  {"permissions": [{"obj": "", "act": ""}]}
+//	GET    /roles/:role/parents
+//	POST   /roles/:role/parents      {"roles": []}
+//	DELETE /roles/:role/parents      {"roles": []}
+//	GET    /users/:user/roles
+//	POST   /users/:user/roles        {"roles": [], "expiresAt": null}
+//	DELETE /users/:user/roles        {"roles": []}
+func RegisterAdminRoutes(g *route.RouterGroup, cfg AdminConfig) {
+	if cfg.Object == "" {
+		cfg.Object = DefaultAdminObject
+	}
+	g.Use(adminMiddleware(cfg))
+
+	g.GET("/roles", func(c context.Context, ctx *app.RequestContext) {
+		page(ctx, Server().GetAllRoles())
+	})
+	g.DELETE("/roles/:role", func(c context.Context, ctx *app.RequestContext) {
+		respond(ctx, admin(c).DeleteRole(ctx.Param("role")), nil)
+	})
+
+	g.GET("/roles/:role/users", func(c context.Context, ctx *app.RequestContext) {
+		users, err := Server().GetUsersForRole(ctx.Param("role"))
+		if err != nil {
+			respond(ctx, err, nil)
+			return
+		}
+		page(ctx, users)
+	})
+
+	g.GET("/roles/:role/permissions", func(c context.Context, ctx *app.RequestContext) {
+		page(ctx, Server().GetPermissionsForRole(ctx.Param("role")))
+	})
+	g.POST("/roles/:role/permissions", func(c context.Context, ctx *app.RequestContext) {
+		var req permissionsRequest
+		if !bind(ctx, &req) {
+			return
+		}
+		respond(ctx, admin(c).AddPermissionsForRole(ctx.Param("role"), req.Permissions), nil)
+	})
+	g.DELETE("/roles/:role/permissions", func(c context.Context, ctx *app.RequestContext) {
+		var req permissionsRequest
+		if !bind(ctx, &req) {
+			return
+		}
+		respond(ctx, admin(c).DeletePermissionsForRole(ctx.Param("role"), req.Permissions), nil)
+	})
+
+	g.GET("/roles/:role/parents", func(c context.Context, ctx *app.RequestContext) {
+		parents, err := Server().GetParentsForRole(ctx.Param("role"))
+		respond(ctx, err, parents)
+	})
+	g.POST("/roles/:role/parents", func(c context.Context, ctx *app.RequestContext) {
+		var req rolesRequest
+		if !bind(ctx, &req) {
+			return
+		}
+		respond(ctx, admin(c).AddParentsForRole(ctx.Param("role"), req.Roles), nil)
+	})
+	g.DELETE("/roles/:role/parents", func(c context.Context, ctx *app.RequestContext) {
+		var req rolesRequest
+		if !bind(ctx, &req) {
+			return
+		}
+		respond(ctx, admin(c).DeleteParentsForRole(ctx.Param("role"), req.Roles), nil)
+	})
+
+	g.GET("/users/:user/roles", func(c context.Context, ctx *app.RequestContext) {
+		roles, err := Server().GetRolesForUser(ctx.Param("user"))
+		respond(ctx, err, roles)
+	})
+	g.POST("/users/:user/roles", func(c context.Context, ctx *app.RequestContext) {
+		var req rolesRequest
+		if !bind(ctx, &req) {
+			return
+		}
+		if req.ExpiresAt != nil {
+			respond(ctx, admin(c).AddRolesForUserUntil(
+				ctx.Param("user"), req.Roles, *req.ExpiresAt), nil)
+			return
+		}
+		respond(ctx, admin(c).AddRolesForUser(ctx.Param("user"), req.Roles), nil)
+	})
+	g.DELETE("/users/:user/roles", func(c context.Context, ctx *app.RequestContext) {
+		var req rolesRequest
+		if !bind(ctx, &req) {
+			return
+		}
+		respond(ctx, admin(c).DeleteRolesForUser(ctx.Param("user"), req.Roles), nil)
+	})
+}
+
+func adminMiddleware(cfg AdminConfig) app.HandlerFunc {
+	return func(c context.Context, ctx *app.RequestContext) {
+		userCtx := token.GetContext(c).UserCtx
+		if userCtx == nil {
+			ctx.AbortWithStatusJSON(consts.StatusUnauthorized, utils.H{
+				"err":  cfg.ErrMsg,
+				"code": cfg.ErrCode,
+			})
+			return
+		}
+		if !Server().Enforce(strconv.FormatInt(userCtx.Id, 10), cfg.Object) {
+			ctx.AbortWithStatusJSON(consts.StatusForbidden, utils.H{
+				"err":  cfg.ErrMsg,
+				"code": cfg.ErrCode,
+			})
+			return
+		}
+		ctx.Next(c)
+	}
+}
+
+// admin returns the server which audits the changes as made by the user,
+// who is checked by adminMiddleware.
+func admin(c context.Context) *AuthServer {
+	return Server().As(strconv.FormatInt(token.GetContext(c).UserCtx.Id, 10))
+}
+
+func bind(ctx *app.RequestContext, req interface{}) bool {
+	if err := ctx.BindJSON(req); err != nil {
+		ctx.JSON(consts.StatusBadRequest, utils.H{
+			"err":  constants.AuthAdminBadRequestMsg,
+			"code": constants.AuthAdminBadRequest,
+		})
+		return false
+	}
+	return true
+}
+
+func respond(ctx *app.RequestContext, err error, data interface{}) {
+	switch {
+	case err == nil:
+		ctx.JSON(consts.StatusOK, utils.H{
+			"msg":  constants.AuthAdminSuccessMsg,
+			"code": constants.AuthAdminSuccess,
+			"data": data,
+		})
+	case errors.Is(err, ErrRoleCycle), errors.Is(err, ErrDenyUnsupported),
+		errors.Is(err, ErrABACUnsupported), errors.Is(err, ErrEmptyCondition),
+		errors.Is(err, ErrInvalidEffect), errors.Is(err, ErrInvalidExpiry),
+		errors.Is(err, ErrConditionTooLong), errors.Is(err, ErrObjectTooLong):
+		ctx.JSON(consts.StatusBadRequest, utils.H{
+			"err":  err.Error(),
+			"code": constants.AuthAdminBadRequest,
+		})
+	default:
+		ctx.JSON(consts.StatusInternalServerError, utils.H{
+			"err":  constants.AuthAdminFailedMsg,
+			"code": constants.AuthAdminFailed,
+		})
+	}
+}
+
+// page responds with the page of items given by the page and size queries,
+// together with the number of all the items.
+func page[T any](ctx *app.RequestContext, items []T) {
+	p, err := strconv.Atoi(ctx.DefaultQuery("page", "1"))
+	if err != nil || p < 1 {
+		p = 1
+	}
+	size, err := strconv.Atoi(ctx.DefaultQuery("size", strconv.Itoa(defaultPageSize)))
+	if err != nil || size < 1 || size > maxPageSize {
+		size = defaultPageSize
+	}
+
+	total := len(items)
+	// compared before multiplying, which overflows for large pages
+	start := total
+	if p-1 <= total/size {
+		start = (p - 1) * size
+	}
+	if start > total {
+		start = total
+	}
+	end := start + size
+	if end > total {
+		end = total
+	}
+	ctx.JSON(consts.StatusOK, utils.H{
+		"msg":  constants.AuthAdminSuccessMsg,
+		"code": constants.AuthAdminSuccess,
+		"data": utils.H{
+			"items": items[start:end],
+			"total": total,
+		},
+	})
+}
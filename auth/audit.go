@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"gorm.io/gorm"
+)
+
+const (
+	AuditChange = "change"
+	AuditDenial = "denial"
+)
+
+const auditQueueSize = 1024
+
+// AuditLog is a change of the policies, or a denied access attempt.
+// Added and Removed are only the rules added and removed by the change as
+// JSON, every rule starting with its policy type, so the policies before
+// and after a change are those of the changes before it. Expiries are the
+// changed expirations of the role assignments as JSON, see ExpiryChange.
+// Request is the denied request as JSON.
+type AuditLog struct {
+	Id        uint      `gorm:"primaryKey" json:"id"`
+	Kind      string    `gorm:"size:20;index" json:"kind"`
+	Actor     string    `gorm:"size:100;index" json:"actor"`
+	Added     string    `gorm:"type:text" json:"added,omitempty"`
+	Removed   string    `gorm:"type:text" json:"removed,omitempty"`
+	Expiries  string    `gorm:"type:text" json:"expiries,omitempty"`
+	Request   string    `gorm:"size:500" json:"request,omitempty"`
+	CreatedAt time.Time `gorm:"index" json:"createdAt"`
+}
+
+type AuditQuery struct {
+	Kind   string
+	Actor  string
+	Since  time.Time
+	Until  time.Time
+	Offset int
+	Limit  int
+}
+
+// auditor writes the audit logs. Changes are written in the transaction
+// of the change, denials are sampled and written in background so that
+// Enforce never waits for the database.
+type auditor struct {
+	db         *gorm.DB
+	table      string
+	sampleRate float64
+	denials    chan AuditLog
+}
+
+func newAuditor(db *gorm.DB, table string, sampleRate float64) (*auditor, error) {
+	if err := db.Table(table).AutoMigrate(&AuditLog{}); err != nil {
+		return nil, err
+	}
+	au := &auditor{db: db, table: table, sampleRate: sampleRate}
+	if sampleRate > 0 {
+		au.denials = make(chan AuditLog, auditQueueSize)
+		go au.writeDenials()
+	}
+	return au, nil
+}
+
+func (au *auditor) recordChange(tx *gorm.DB, actor string,
+	changes []policyOp, expiries []ExpiryChange) error {
+
+	var added, removed [][]string
+	for _, v := range changes {
+		for _, v1 := range v.rules {
+			rule := append([]string{v.ptype}, v1...)
+			if v.remove {
+				removed = append(removed, rule)
+			} else {
+				added = append(added, rule)
+			}
+		}
+	}
+
+	log := AuditLog{Kind: AuditChange, Actor: actor, CreatedAt: time.Now()}
+	var err error
+	if len(added) != 0 {
+		if log.Added, err = sonic.MarshalString(added); err != nil {
+			return err
+		}
+	}
+	if len(removed) != 0 {
+		if log.Removed, err = sonic.MarshalString(removed); err != nil {
+			return err
+		}
+	}
+	if len(expiries) != 0 {
+		if log.Expiries, err = sonic.MarshalString(expiries); err != nil {
+			return err
+		}
+	}
+	return tx.Table(au.table).Create(&log).Error
+}
+
+// recordDenial samples the denied request, it is dropped when the queue
+// is full.
+func (au *auditor) recordDenial(user string, request ...string) {
+	if au == nil || au.sampleRate <= 0 || rand.Float64() >= au.sampleRate {
+		return
+	}
+	data, err := sonic.MarshalString(request)
+	if err != nil {
+		return
+	}
+	select {
+	case au.denials <- AuditLog{
+		Kind:      AuditDenial,
+		Actor:     user,
+		Request:   data,
+		CreatedAt: time.Now(),
+	}:
+	default:
+	}
+}
+
+func (au *auditor) writeDenials() {
+	for v := range au.denials {
+		_ = au.db.Table(au.table).Create(&v).Error
+	}
+}
+
+func (au *auditor) query(q AuditQuery) (logs []AuditLog, total int64, err error) {
+	db := au.db.Table(au.table)
+	if q.Kind != "" {
+		db = db.Where("kind = ?", q.Kind)
+	}
+	if q.Actor != "" {
+		db = db.Where("actor = ?", q.Actor)
+	}
+	if !q.Since.IsZero() {
+		db = db.Where("created_at >= ?", q.Since)
+	}
+	if !q.Until.IsZero() {
+		db = db.Where("created_at < ?", q.Until)
+	}
+	if err = db.Count(&total).Error; err != nil {
+		return
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = 20
+	}
+	err = db.Order("id DESC").Offset(q.Offset).Limit(q.Limit).Find(&logs).Error
+	return
+}
+
+// As returns the server whose changes are audited as made by the actor,
+// such as the administrator signed in to the console.
+func (a *AuthServer) As(actor string) *AuthServer {
+	b := *a
+	b.actor = actor
+	return &b
+}
+
+// QueryAuditLogs returns a page of the audit logs, the newest first, and
+// the number of the logs matching the query.
+func (a *AuthServer) QueryAuditLogs(q AuditQuery) ([]AuditLog, int64, error) {
+	return a.auditor.query(q)
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type CacheStats struct {
+	Hits          int64
+	Misses        int64
+	Invalidations int64
+	Size          int
+}
+
+// decisionCache keeps the results of Enforce until the policies change.
+// A result computed while the policies changed is not stored, because the
+// generation it was read at is outdated.
+type decisionCache struct {
+	mu            sync.RWMutex
+	capacity      int
+	generation    uint64
+	items         map[string]bool
+	hits          atomic.Int64
+	misses        atomic.Int64
+	invalidations atomic.Int64
+}
+
+func newDecisionCache(capacity int) *decisionCache {
+	return &decisionCache{
+		capacity: capacity,
+		items:    make(map[string]bool, capacity),
+	}
+}
+
+func (c *decisionCache) get(key string) (b bool, ok bool, generation uint64) {
+	c.mu.RLock()
+	b, ok = c.items[key]
+	generation = c.generation
+	c.mu.RUnlock()
+
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return
+}
+
+func (c *decisionCache) set(key string, b bool, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	// start over rather than tracking the usage of every entry
+	if len(c.items) >= c.capacity {
+		c.items = make(map[string]bool, c.capacity)
+	}
+	c.items[key] = b
+}
+
+func (c *decisionCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.items = make(map[string]bool, c.capacity)
+	c.invalidations.Add(1)
+}
+
+func (c *decisionCache) stats() CacheStats {
+	c.mu.RLock()
+	size := len(c.items)
+	c.mu.RUnlock()
+
+	return CacheStats{
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Invalidations: c.invalidations.Load(),
+		Size:          size,
+	}
+}
@@ -1,36 +1,75 @@
 package auth
 
 import (
+	"reflect"
+
+	"github.com/bytedance/sonic"
 	"github.com/casbin/casbin/v2"
 	redisadapter "github.com/casbin/redis-adapter/v3"
 )
 
 type AuthClient struct {
-	e            *casbin.Enforcer
-	userPrefix   string
-	rolePrefix   string
-	policyPrefix string
-	action       string
+	naming
+	e             *casbin.SyncedEnforcer
+	watcher       *policyWatcher
+	cache         *decisionCache
+	auditor       *auditor
+	health        *healthState
+	failMode      FailMode
+	withABAC      bool
+	withDataScope bool
 }
 
 var c *AuthClient
 
-func NewClient(modelPath string, policy_redis string) {
+// modelPath may be empty for DefaultModel.
+func NewClient(modelPath string, policy_redis string, opts ...Option) {
 	once.Do(func() {
+		o := newOptions(opts)
 		c = new(AuthClient)
-		c.userPrefix = "u_"
-		c.rolePrefix = "r_"
-		c.policyPrefix = "p_"
-		c.action = "Allow"
+		c.naming = o.naming
+		c.failMode = o.failMode
+		c.health = newHealthState(func() {
+			c.reload()
+		})
+		if o.cacheSize > 0 {
+			c.cache = newDecisionCache(o.cacheSize)
+		}
+		// Denials are written only when the client is given the database
+		if o.auditDB != nil {
+			var err error
+			c.auditor, err = newAuditor(o.auditDB, o.auditTable, o.denialSampleRate)
+			if err != nil {
+				panic(err)
+			}
+		}
 
 		r, err := redisadapter.NewAdapter("tcp", policy_redis)
 		if err != nil {
 			panic(err)
 		}
-		c.e, err = casbin.NewEnforcer(modelPath, r)
+		c.e, err = c.newEnforcer(modelPath, r)
+		if err != nil {
+			panic(err)
+		}
+		if err = validateModel(c.e.GetModel()); err != nil {
+			panic(err)
+		}
+		c.withABAC, _ = hasABAC(c.e.GetModel())
+		c.withDataScope, _ = hasDataScope(c.e.GetModel())
+		// Client is read only, changes are received from the watcher
+		c.e.EnableAutoSave(false)
+
+		c.watcher, err = newPolicyWatcher(policy_redis, policyChannel)
 		if err != nil {
 			panic(err)
 		}
+		c.watcher.SetUpdateCallback(c.onPolicyChange)
+		// Reload the changes made before the callback was set
+		if err = c.e.LoadPolicy(); err != nil {
+			panic(err)
+		}
+		go c.health.watch(c.watcher.ping, nil)
 	})
 }
 
@@ -38,51 +77,175 @@ func Client() *AuthClient {
 	return c
 }
 
+// Enforcer checks whether the user may access the object, it is
+// implemented by AuthClient and AuthServer.
+type Enforcer interface {
+	Enforce(user string, obj string) bool
+}
+
+// enforceWith checks by e, or by AuthClient, or by AuthServer in the
+// processes which create the server instead, since only one of them is
+// created. Nothing is allowed before either is created.
+func enforceWith(e Enforcer, user string, obj string) bool {
+	switch {
+	case !isNil(e):
+	case c != nil:
+		e = c
+	case s != nil:
+		e = s
+	default:
+		return false
+	}
+	return e.Enforce(user, obj)
+}
+
+// isNil reports whether e is nil, also when it holds a nil pointer such as
+// Client() before NewClient.
+func isNil(e Enforcer) bool {
+	if e == nil {
+		return true
+	}
+	v := reflect.ValueOf(e)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Func, reflect.Chan, reflect.Slice,
+		reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
 func (a *AuthClient) GetRolesForUser(user string) (roles []string, err error) {
 	user = a.userPrefix + user
 	roles, err = a.e.GetRolesForUser(user)
-	prefixLen := len(a.rolePrefix)
 	if err != nil {
 		return
 	}
+	roles = a.trimRoles(roles)
+	return
+}
 
-	for k, v := range roles {
-		roles[k] = v[prefixLen:]
+func (a *AuthClient) GetPoliciesForRole(role string) (objs []string) {
+	for _, v := range a.GetPermissionsForRole(role) {
+		if v.Eft != EffectDeny {
+			objs = append(objs, v.Obj)
+		}
 	}
 	return
 }
 
-func (a *AuthClient) GetPoliciesForRole(role string) (objs []string) {
-	prefixLen := len(a.policyPrefix)
+func (a *AuthClient) GetPermissionsForRole(role string) (perms []Permission) {
 	role = a.rolePrefix + role
 
-	policies := a.e.GetFilteredPolicy(0, role)
-	if len(policies) == 0 {
-		return
-	}
-	for _, v := range policies {
-		objs = append(objs, v[1][prefixLen:])
-	}
-	return
+	return a.parsePermissions(a.e.GetFilteredPolicy(0, role))
 }
 
+// GetPoliciesForUser returns the allowed objects of the user's roles as
+// they are granted, patterns included, leaving out those denied by any of
+// the roles.
 func (a *AuthClient) GetPoliciesForUser(user string) (objs []string) {
+	for _, v := range permissionSet(a.GetPermissionsForUser(user)) {
+		objs = append(objs, v.Obj)
+	}
+
+	// the objects may be granted with several actions
+	return distinct(objs)
+}
+
+func (a *AuthClient) GetPermissionsForUser(user string) (perms []Permission) {
 	roles, err := a.GetRolesForUser(user)
 	if err != nil || len(roles) == 0 {
 		return
 	}
 
 	for _, v := range roles {
-		objs = append(objs, a.GetPoliciesForRole(v)...)
+		perms = append(perms, a.GetPermissionsForRole(v)...)
 	}
 
 	return
 }
 
 func (a *AuthClient) Enforce(user string, obj string) (b bool) {
-	user = a.userPrefix + user
-	obj = a.policyPrefix + obj
+	return a.EnforceAction(user, obj, a.action)
+}
+
+func (a *AuthClient) EnforceAction(user string, obj string, act string) (b bool) {
+	b, err := a.enforce(a.userPrefix+user, a.policyPrefix+obj, act)
+	if err != nil || !a.health.redisUp() {
+		b = a.failMode.decide(b, err)
+	}
+	if !b {
+		a.auditor.recordDenial(user, obj, act)
+	}
+	return
+}
+
+func (a *AuthClient) enforce(sub string, obj string, act string) (b bool, err error) {
+	if a.cache == nil {
+		return a.e.Enforce(sub, obj, act)
+	}
+
+	key := ruleKey([]string{sub, obj, act})
+	b, ok, generation := a.cache.get(key)
+	if ok {
+		return
+	}
+	b, err = a.e.Enforce(sub, obj, act)
+	if err == nil {
+		a.cache.set(key, b, generation)
+	}
+	return
+}
 
-	b, _ = a.e.Enforce(user, obj, a.action)
+// CacheStats returns the statistics of the decision cache, which are all
+// zero when the cache is not enabled by WithDecisionCache.
+func (a *AuthClient) CacheStats() CacheStats {
+	if a.cache == nil {
+		return CacheStats{}
+	}
+	return a.cache.stats()
+}
+
+// BatchEnforce checks the default action on every object at once, such as
+// the menu items a user may see. Every object goes through EnforceAction,
+// so the results are cached and the denials are audited the same way.
+func (a *AuthClient) BatchEnforce(user string, objs []string) (m map[string]bool) {
+	m = make(map[string]bool, len(objs))
+	for _, v := range objs {
+		m[v] = a.EnforceAction(user, v, a.action)
+	}
 	return
 }
+
+// GetPermissionSetForUser returns the distinct permissions of the user and
+// of the roles they inherit, sorted so that it can be sent to the frontend.
+func (a *AuthClient) GetPermissionSetForUser(user string) []Permission {
+	return permissionSet(a.GetImplicitPermissionsForUser(user))
+}
+
+func (a *AuthClient) onPolicyChange(msg string) {
+	m := policyMessage{}
+	err := sonic.UnmarshalString(msg, &m)
+	if err != nil {
+		m.Method = methodUpdate
+	}
+
+	switch m.Method {
+	case methodAddPolicies:
+		_, err = a.e.SelfAddPoliciesEx(m.Sec, m.Ptype, m.Rules)
+	case methodRemovePolicies:
+		_, err = a.e.SelfRemovePolicies(m.Sec, m.Ptype, m.Rules)
+	case methodRemoveFilteredPolicy:
+		_, err = a.e.SelfRemoveFilteredPolicy(
+			m.Sec, m.Ptype, m.FieldIndex, m.FieldValues...)
+	default:
+		err = a.e.LoadPolicy()
+	}
+
+	// Fall back to a full reload if the change can not be applied
+	if err != nil {
+		_ = a.e.LoadPolicy()
+	}
+	if a.cache != nil {
+		a.cache.invalidate()
+	}
+}
@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/casbin/casbin/v2/model"
+	"github.com/wheelergeo/g-otter-pkg/token"
+	"gorm.io/gorm"
+)
+
+// DataScope limits the rows a role sees, the model stores it by a third
+// policy, which is not used by the matchers:
+//
+//	[policy_definition]
+//	p3 = sub, scope, dept
+type DataScope string
+
+const (
+	ScopeAll          DataScope = "all"
+	ScopeCustom       DataScope = "custom"
+	ScopeDept         DataScope = "dept"
+	ScopeDeptAndBelow DataScope = "dept_and_below"
+	ScopeSelf         DataScope = "self"
+)
+
+// RoleDataScope is the data scope of a role, Depts are the departments of
+// ScopeCustom.
+type RoleDataScope struct {
+	Scope DataScope `json:"scope" yaml:"scope"`
+	Depts []int32   `json:"depts,omitempty" yaml:"depts,omitempty"`
+}
+
+type DataScopeConfig struct {
+	// Column of the department of a row, dept_id by default
+	DeptColumn string
+	// Column of the user who owns a row, create_by by default
+	UserColumn string
+	// Returns the department together with all the departments below it,
+	// ScopeDeptAndBelow is taken as ScopeDept without it
+	DeptTree func(c context.Context, dept int32) ([]int32, error)
+}
+
+const dataScopePtype = "p3"
+
+// noDept fills the dept of the scopes other than ScopeCustom, since the
+// adapters drop the empty fields at the end of a rule.
+const noDept = "-"
+
+var (
+	ErrDataScopeUnsupported = errors.New("the model has no p3 for data scopes")
+	ErrInvalidDataScope     = errors.New("invalid data scope")
+)
+
+// hasDataScope reports whether the model defines the data scopes, and
+// checks that it defines them the way they are written.
+func hasDataScope(m model.Model) (ok bool, err error) {
+	p, ok := m["p"][dataScopePtype]
+	if !ok {
+		return
+	}
+	if !equalTokens(p.Tokens, "p3_sub", "p3_scope", "p3_dept") {
+		return false, errors.New(
+			"invalid model: data scope policy must be p3 = sub, scope, dept")
+	}
+	return true, nil
+}
+
+// SetDataScopeForRole replaces the data scope of the role.
+func (a *AuthServer) SetDataScopeForRole(role string, ds RoleDataScope) (err error) {
+	rules, err := a.roleDataScopeRules(role, ds)
+	if err != nil {
+		return
+	}
+
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+	old := a.e[0].GetFilteredNamedPolicy(dataScopePtype, 0, a.rolePrefix+role)
+	return a.commitLocked(
+		removeOp("p", dataScopePtype, subtractRules(old, rules)),
+		addOp("p", dataScopePtype, rules))
+}
+
+func (a *AuthServer) DeleteDataScopeForRole(role string) (err error) {
+	if !a.withDataScope {
+		return ErrDataScopeUnsupported
+	}
+
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+	return a.commitLocked(removeOp("p", dataScopePtype,
+		a.e[0].GetFilteredNamedPolicy(dataScopePtype, 0, a.rolePrefix+role)))
+}
+
+// GetDataScopeForRole returns the data scope of the role, ok is false when
+// it is not set.
+func (a *AuthServer) GetDataScopeForRole(role string) (ds RoleDataScope, ok bool) {
+	if !a.withDataScope {
+		return
+	}
+	role = a.rolePrefix + role
+
+	rules := a.reader().GetFilteredNamedPolicy(dataScopePtype, 0, role)
+	if len(rules) == 0 {
+		rules = a.e[0].GetFilteredNamedPolicy(dataScopePtype, 0, role)
+		if len(rules) != 0 {
+			a.requestSync()
+		}
+	}
+	return a.parseDataScope(rules)
+}
+
+// GetDataScopesForUser returns the data scopes of all the roles of the
+// user, including the inherited ones.
+func (a *AuthServer) GetDataScopesForUser(user string) (scopes []RoleDataScope) {
+	roles, err := a.GetImplicitRolesForUser(user)
+	if err != nil {
+		return
+	}
+	for _, v := range roles {
+		if ds, ok := a.GetDataScopeForRole(v); ok {
+			scopes = append(scopes, ds)
+		}
+	}
+	return
+}
+
+func (a *AuthServer) roleDataScopeRules(role string,
+	ds RoleDataScope) (rules [][]string, err error) {
+
+	if !a.withDataScope {
+		return nil, ErrDataScopeUnsupported
+	}
+	role = a.rolePrefix + role
+
+	switch ds.Scope {
+	case ScopeAll, ScopeDept, ScopeDeptAndBelow, ScopeSelf:
+		return [][]string{{role, string(ds.Scope), noDept}}, nil
+	case ScopeCustom:
+		if len(ds.Depts) == 0 {
+			return nil, ErrInvalidDataScope
+		}
+		for _, v := range ds.Depts {
+			rules = append(rules, []string{
+				role,
+				string(ScopeCustom),
+				strconv.FormatInt(int64(v), 10),
+			})
+		}
+		return
+	}
+	return nil, ErrInvalidDataScope
+}
+
+func (a *AuthClient) GetDataScopeForRole(role string) (RoleDataScope, bool) {
+	if !a.withDataScope {
+		return RoleDataScope{}, false
+	}
+	return a.parseDataScope(
+		a.e.GetFilteredNamedPolicy(dataScopePtype, 0, a.rolePrefix+role))
+}
+
+func (a *AuthClient) GetDataScopesForUser(user string) (scopes []RoleDataScope) {
+	roles, err := a.GetImplicitRolesForUser(user)
+	if err != nil {
+		return
+	}
+	for _, v := range roles {
+		if ds, ok := a.GetDataScopeForRole(v); ok {
+			scopes = append(scopes, ds)
+		}
+	}
+	return
+}
+
+// DataScopeFilter is a GORM scope which limits the query to the rows the
+// user of token.GetContext sees through AuthClient, the union of the data
+// scopes of the user's roles. Users whose roles have no data scope see
+// their own rows only, and requests without a user see none.
+//
+//	db.WithContext(c).Scopes(auth.DataScopeFilter(c, cfg)).Find(&orders)
+func DataScopeFilter(c context.Context, cfg DataScopeConfig) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		userCtx := token.GetContext(c).UserCtx
+		if userCtx == nil {
+			return db.Where("1 = 0")
+		}
+		deptColumn, userColumn := cfg.DeptColumn, cfg.UserColumn
+		if deptColumn == "" {
+			deptColumn = "dept_id"
+		}
+		if userColumn == "" {
+			userColumn = "create_by"
+		}
+
+		scopes := dataScopesForUser(strconv.FormatInt(userCtx.Id, 10))
+		if len(scopes) == 0 {
+			scopes = []RoleDataScope{{Scope: ScopeSelf}}
+		}
+
+		var depts []int32
+		self := false
+		for _, v := range scopes {
+			switch v.Scope {
+			case ScopeAll:
+				return db
+			case ScopeCustom:
+				depts = append(depts, v.Depts...)
+			case ScopeDept:
+				depts = append(depts, userCtx.Dept)
+			case ScopeDeptAndBelow:
+				if cfg.DeptTree == nil {
+					depts = append(depts, userCtx.Dept)
+					continue
+				}
+				tree, err := cfg.DeptTree(c, userCtx.Dept)
+				if err != nil {
+					_ = db.AddError(err)
+					return db.Where("1 = 0")
+				}
+				depts = append(depts, tree...)
+			case ScopeSelf:
+				self = true
+			}
+		}
+
+		switch {
+		case len(depts) != 0 && self:
+			return db.Where("("+deptColumn+" IN ? OR "+userColumn+" = ?)",
+				depts, userCtx.Id)
+		case len(depts) != 0:
+			return db.Where(deptColumn+" IN ?", depts)
+		default:
+			return db.Where(userColumn+" = ?", userCtx.Id)
+		}
+	}
+}
+
+func (n *naming) parseDataScope(rules [][]string) (ds RoleDataScope, ok bool) {
+	for _, v := range rules {
+		if len(v) != 3 || !strings.HasPrefix(v[0], n.rolePrefix) {
+			n.malformed(v)
+			continue
+		}
+		ds.Scope = DataScope(v[1])
+		ok = true
+		if ds.Scope != ScopeCustom {
+			continue
+		}
+		dept, err := strconv.ParseInt(v[2], 10, 32)
+		if err != nil {
+			n.malformed(v)
+			continue
+		}
+		ds.Depts = append(ds.Depts, int32(dept))
+	}
+	return
+}
+
+// dataScopesForUser reads the scopes by AuthClient, or by AuthServer in
+// the processes which create the server instead.
+func dataScopesForUser(user string) []RoleDataScope {
+	switch {
+	case c != nil:
+		return c.GetDataScopesForUser(user)
+	case s != nil:
+		return s.GetDataScopesForUser(user)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const defaultSweepInterval = time.Minute
+
+// sweepActor is the actor of the expirations in the audit logs.
+const sweepActor = "expiry-sweeper"
+
+// RoleExpiration is a role assignment which is removed at ExpiresAt, the
+// names are stored without the prefixes.
+type RoleExpiration struct {
+	Id        uint      `gorm:"primaryKey" json:"-"`
+	User      string    `gorm:"column:user_name;size:100;uniqueIndex:idx_user_role" json:"user"`
+	Role      string    `gorm:"column:role_name;size:100;uniqueIndex:idx_user_role" json:"role"`
+	ExpiresAt time.Time `gorm:"index" json:"expiresAt"`
+}
+
+// ExpiryChange is a change of the expiry of a role assignment in the audit
+// logs, Before is nil for a new expiry and After is nil for a removed one.
+type ExpiryChange struct {
+	User   string     `json:"user"`
+	Role   string     `json:"role"`
+	Before *time.Time `json:"before,omitempty"`
+	After  *time.Time `json:"after,omitempty"`
+}
+
+func (a *AuthServer) expiryTable() string {
+	return a.table + "_expiry"
+}
+
+func (a *AuthServer) migrateExpiry() error {
+	return a.db.Table(a.expiryTable()).AutoMigrate(&RoleExpiration{})
+}
+
+var ErrInvalidExpiry = errors.New("the expiry must be in the future")
+
+// AddRolesForUserUntil grants the roles until expiry, such as elevated
+// roles for an on-call shift. Granting a role the user has until another
+// time sets the expiry of that role, while the roles the user has
+// permanently are kept permanent.
+func (a *AuthServer) AddRolesForUserUntil(user string, roles []string,
+	expiry time.Time) (err error) {
+
+	if !expiry.After(time.Now()) {
+		return ErrInvalidExpiry
+	}
+
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+
+	roles = distinct(roles)
+	current, err := a.expirations(a.db, user, roles)
+	if err != nil {
+		return
+	}
+	rows := make([]RoleExpiration, 0, len(roles))
+	var changes []ExpiryChange
+	for _, v := range roles {
+		old, ok := current[v]
+		if !ok && a.e[0].HasNamedGroupingPolicy("g", a.userPrefix+user, a.rolePrefix+v) {
+			continue
+		}
+		rows = append(rows, RoleExpiration{User: user, Role: v, ExpiresAt: expiry})
+		change := ExpiryChange{User: user, Role: v, After: &expiry}
+		if ok {
+			change.Before = &old.ExpiresAt
+		}
+		changes = append(changes, change)
+	}
+
+	return a.commitLockedWith(func(tx *gorm.DB) ([]ExpiryChange, error) {
+		if len(rows) == 0 {
+			return nil, nil
+		}
+		return changes, tx.Table(a.expiryTable()).Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_name"}, {Name: "role_name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"expires_at"}),
+		}).Create(&rows).Error
+	}, addOp("g", "g", a.userRoleRules(user, rolesOf(rows))))
+}
+
+// expirations returns the expirations of the roles of the user by role.
+func (a *AuthServer) expirations(db *gorm.DB, user string,
+	roles []string) (m map[string]RoleExpiration, err error) {
+
+	var rows []RoleExpiration
+	if len(roles) != 0 {
+		err = db.Table(a.expiryTable()).
+			Where("user_name = ? AND role_name IN ?", user, roles).
+			Find(&rows).Error
+	}
+	m = make(map[string]RoleExpiration, len(rows))
+	for _, v := range rows {
+		m[v.Role] = v
+	}
+	return
+}
+
+func rolesOf(rows []RoleExpiration) (roles []string) {
+	for _, v := range rows {
+		roles = append(roles, v.Role)
+	}
+	return
+}
+
+// GetRoleExpirations returns the assignments which expire within d, the
+// soonest first.
+func (a *AuthServer) GetRoleExpirations(d time.Duration) (rows []RoleExpiration, err error) {
+	err = a.db.Table(a.expiryTable()).
+		Where("expires_at <= ?", time.Now().Add(d)).
+		Order("expires_at").
+		Find(&rows).Error
+	return
+}
+
+func (a *AuthServer) GetRoleExpirationsForUser(user string) (rows []RoleExpiration, err error) {
+	err = a.db.Table(a.expiryTable()).
+		Where("user_name = ?", user).
+		Order("expires_at").
+		Find(&rows).Error
+	return
+}
+
+// deleteExpiry makes the roles of the user permanent, or forgets them when
+// they are deleted.
+func (a *AuthServer) deleteExpiry(user string,
+	roles []string) func(tx *gorm.DB) ([]ExpiryChange, error) {
+
+	return func(tx *gorm.DB) ([]ExpiryChange, error) {
+		if len(roles) == 0 {
+			return nil, nil
+		}
+		return a.deleteExpirations(tx,
+			"user_name = ? AND role_name IN ?", user, roles)
+	}
+}
+
+// deleteExpirations deletes the expirations matching the condition and
+// returns them as changes.
+func (a *AuthServer) deleteExpirations(tx *gorm.DB, query string,
+	args ...interface{}) (changes []ExpiryChange, err error) {
+
+	var rows []RoleExpiration
+	if err = tx.Table(a.expiryTable()).Where(query, args...).Find(&rows).Error; err != nil {
+		return
+	}
+	if len(rows) == 0 {
+		return
+	}
+	ids := make([]uint, 0, len(rows))
+	for _, v := range rows {
+		ids = append(ids, v.Id)
+		expiresAt := v.ExpiresAt
+		changes = append(changes, ExpiryChange{User: v.User, Role: v.Role, Before: &expiresAt})
+	}
+	err = tx.Table(a.expiryTable()).
+		Where("id IN ?", ids).
+		Delete(&RoleExpiration{}).Error
+	return
+}
+
+// sweepExpired removes the expired assignments from the database and
+// redis together with their expirations.
+func (a *AuthServer) sweepExpired() (err error) {
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+
+	var rows []RoleExpiration
+	err = a.db.Table(a.expiryTable()).
+		Where("expires_at <= ?", time.Now()).
+		Find(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return
+	}
+
+	ids := make([]uint, 0, len(rows))
+	rules := make([][]string, 0, len(rows))
+	for _, v := range rows {
+		ids = append(ids, v.Id)
+		rules = append(rules, []string{a.userPrefix + v.User, a.rolePrefix + v.Role})
+	}
+	return a.commitLockedWith(func(tx *gorm.DB) ([]ExpiryChange, error) {
+		return a.deleteExpirations(tx, "id IN ?", ids)
+	}, removeOp("g", "g", rules))
+}
+
+func (a *AuthServer) sweep(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for range ticker.C {
+		// failed sweeps are retried on the next tick
+		_ = a.As(sweepActor).sweepExpired()
+	}
+}
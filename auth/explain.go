@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"github.com/casbin/casbin/v2"
+)
+
+// Explanation tells why a request is allowed or denied. Permission is the
+// policy which decided it, granted to Role, and Chain is the path of the
+// roles from the role of the user to Role. Permission is nil when no
+// policy matched.
+type Explanation struct {
+	Allowed    bool        `json:"allowed"`
+	Role       string      `json:"role,omitempty"`
+	Permission *Permission `json:"permission,omitempty"`
+	Chain      []string    `json:"chain,omitempty"`
+}
+
+// PolicyChange is a change of the policies which is not written, for
+// checking its effect by EnforceWhatIf.
+type PolicyChange struct {
+	Add    *PolicyData
+	Remove *PolicyData
+}
+
+func (a *AuthServer) EnforceEx(user string, obj string, act string) (x Explanation, err error) {
+	x, err = a.explain(a.reader(), user, obj, act)
+	if err != nil {
+		x, err = a.explain(a.e[0], user, obj, act)
+	}
+	return
+}
+
+// EnforceWhatIf explains the decision as if the change was made, on a copy
+// of the policies in the database.
+func (a *AuthServer) EnforceWhatIf(change PolicyChange, user string,
+	obj string, act string) (x Explanation, err error) {
+
+	e, err := a.newEnforcer(a.model)
+	if err != nil {
+		return
+	}
+	for _, sec := range []string{"g", "p"} {
+		for ptype := range e.GetModel()[sec] {
+			rules := namedRules(a.e[0], sec, ptype)
+			if len(rules) == 0 {
+				continue
+			}
+			if err = addNamedRules(e, sec, ptype, rules); err != nil {
+				return
+			}
+		}
+	}
+
+	if change.Remove != nil {
+		if err = a.applyChange(e, change.Remove, true); err != nil {
+			return
+		}
+	}
+	if change.Add != nil {
+		if err = a.applyChange(e, change.Add, false); err != nil {
+			return
+		}
+	}
+	return a.explain(e, user, obj, act)
+}
+
+func (a *AuthServer) applyChange(e *casbin.SyncedEnforcer, d *PolicyData,
+	remove bool) (err error) {
+
+	// the data scopes do not change the decisions
+	groupings, policies, conditions, _, err := a.policyRules(d)
+	if err != nil {
+		return
+	}
+	for _, v := range []policyOp{
+		{sec: "g", ptype: "g", rules: groupings},
+		{sec: "p", ptype: "p", rules: policies},
+		{sec: "p", ptype: abacPtype, rules: conditions},
+	} {
+		v.rules = filterRules(e, v.sec, v.ptype, v.rules, remove)
+		if len(v.rules) == 0 {
+			continue
+		}
+		if remove {
+			err = removeNamedRules(e, v.sec, v.ptype, v.rules)
+		} else {
+			err = addNamedRules(e, v.sec, v.ptype, v.rules)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (a *AuthClient) EnforceEx(user string, obj string, act string) (Explanation, error) {
+	return a.explain(a.e, user, obj, act)
+}
+
+func (n *naming) explain(e *casbin.SyncedEnforcer, user string, obj string,
+	act string) (x Explanation, err error) {
+
+	sub := n.userPrefix + user
+	var rule []string
+	x.Allowed, rule, err = e.EnforceEx(sub, n.policyPrefix+obj, act)
+	if err != nil || len(rule) == 0 {
+		return
+	}
+
+	p, ok := n.parsePermission(rule)
+	if !ok {
+		return
+	}
+	x.Permission = &p
+	x.Role = rule[0][len(n.rolePrefix):]
+	x.Chain = n.trimRoles(roleChain(e, sub, rule[0]))
+	return
+}
@@ -0,0 +1,483 @@
+package auth
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type Format string
+
+const (
+	FormatYAML Format = "yaml"
+	FormatCSV  Format = "csv"
+)
+
+const (
+	csvUserRole   = "user_role"
+	csvRoleParent = "role_parent"
+	csvPermission = "permission"
+	csvCondition  = "condition"
+	csvDataScope  = "data_scope"
+)
+
+// PolicyData holds all the roles, role assignments and permissions without
+// the prefixes, it is the unit of export and import.
+type PolicyData struct {
+	UserRoles       map[string][]string     `yaml:"userRoles,omitempty"`
+	RoleParents     map[string][]string     `yaml:"roleParents,omitempty"`
+	RolePermissions map[string][]Permission `yaml:"rolePermissions,omitempty"`
+	// Only with a model for ABAC
+	RoleConditions map[string][]ConditionalPermission `yaml:"roleConditions,omitempty"`
+	// Only with a model for data scopes
+	RoleDataScopes map[string]RoleDataScope `yaml:"roleDataScopes,omitempty"`
+}
+
+// PolicyDiff is what an import adds and removes.
+type PolicyDiff struct {
+	Added   PolicyData `yaml:"added"`
+	Removed PolicyData `yaml:"removed"`
+}
+
+type ImportOption struct {
+	// Only compute the diff, nothing is written
+	DryRun bool
+	// Remove the rules which are not in the imported data, by default the
+	// import only adds the missing rules
+	Prune bool
+}
+
+var ErrUnknownFormat = errors.New("unknown policy format")
+
+// Roles returns all the roles named in the data, sorted.
+func (d *PolicyData) Roles() []string {
+	var roles []string
+	for _, v := range d.UserRoles {
+		roles = append(roles, v...)
+	}
+	for k, v := range d.RoleParents {
+		roles = append(roles, k)
+		roles = append(roles, v...)
+	}
+	for k := range d.RolePermissions {
+		roles = append(roles, k)
+	}
+	for k := range d.RoleConditions {
+		roles = append(roles, k)
+	}
+	for k := range d.RoleDataScopes {
+		roles = append(roles, k)
+	}
+	roles = distinct(roles)
+	sort.Strings(roles)
+	return roles
+}
+
+func (d *PolicyData) IsEmpty() bool {
+	return len(d.UserRoles) == 0 && len(d.RoleParents) == 0 &&
+		len(d.RolePermissions) == 0 && len(d.RoleConditions) == 0 &&
+		len(d.RoleDataScopes) == 0
+}
+
+// Export returns all the policies stored in the database.
+func (a *AuthServer) Export() *PolicyData {
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+	return a.policyData(
+		a.e[0].GetNamedGroupingPolicy("g"),
+		a.e[0].GetNamedPolicy("p"),
+		a.conditionRules(),
+		a.dataScopeRules(),
+	)
+}
+
+// Import writes the policies of data which are missing, and removes the
+// ones which data does not have when opt.Prune is set. The data scope of
+// a role in data replaces the current one, since a role has one scope.
+// Importing the same data twice changes nothing the second time.
+func (a *AuthServer) Import(data *PolicyData,
+	opt ImportOption) (diff *PolicyDiff, err error) {
+
+	groupings, policies, conditions, scopes, err := a.policyRules(data)
+	if err != nil {
+		return
+	}
+
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+
+	addG, removeG := diffRules(groupings, a.e[0].GetNamedGroupingPolicy("g"))
+	addP, removeP := diffRules(policies, a.e[0].GetNamedPolicy("p"))
+	addC, removeC := diffRules(conditions, a.conditionRules())
+	addS, removeS := diffRules(scopes, a.dataScopeRules())
+	if !opt.Prune {
+		removeG, removeP, removeC = nil, nil, nil
+		// only the scopes of the imported roles are replaced
+		var replaced [][]string
+		for _, v := range removeS {
+			if !strings.HasPrefix(v[0], a.rolePrefix) {
+				a.malformed(v)
+				continue
+			}
+			if _, ok := data.RoleDataScopes[v[0][len(a.rolePrefix):]]; ok {
+				replaced = append(replaced, v)
+			}
+		}
+		removeS = replaced
+	}
+
+	// the role inheritance after the import must stay acyclic
+	_, current := a.splitGroupings(a.e[0].GetNamedGroupingPolicy("g"))
+	_, removed := a.splitGroupings(removeG)
+	_, added := a.splitGroupings(addG)
+	if hasCycle(append(subtractRules(current, removed), added...)) {
+		return nil, ErrRoleCycle
+	}
+
+	diff = &PolicyDiff{
+		Added:   *a.policyData(addG, addP, addC, addS),
+		Removed: *a.policyData(removeG, removeP, removeC, removeS),
+	}
+	if opt.DryRun {
+		return
+	}
+	err = a.commitLocked(
+		removeOp("g", "g", removeG),
+		removeOp("p", "p", removeP),
+		removeOp("p", abacPtype, removeC),
+		removeOp("p", dataScopePtype, removeS),
+		addOp("g", "g", addG),
+		addOp("p", "p", addP),
+		addOp("p", abacPtype, addC),
+		addOp("p", dataScopePtype, addS),
+	)
+	return
+}
+
+func (a *AuthServer) conditionRules() [][]string {
+	if !a.withABAC {
+		return nil
+	}
+	return a.e[0].GetNamedPolicy(abacPtype)
+}
+
+func (a *AuthServer) dataScopeRules() [][]string {
+	if !a.withDataScope {
+		return nil
+	}
+	return a.e[0].GetNamedPolicy(dataScopePtype)
+}
+
+func (a *AuthServer) policyData(groupings [][]string, policies [][]string,
+	conditions [][]string, scopes [][]string) *PolicyData {
+
+	d := &PolicyData{
+		UserRoles:       make(map[string][]string),
+		RoleParents:     make(map[string][]string),
+		RolePermissions: make(map[string][]Permission),
+		RoleConditions:  make(map[string][]ConditionalPermission),
+		RoleDataScopes:  make(map[string]RoleDataScope),
+	}
+
+	userRoles, roleParents := a.splitGroupings(groupings)
+	for _, v := range userRoles {
+		if !strings.HasPrefix(v[0], a.userPrefix) ||
+			!strings.HasPrefix(v[1], a.rolePrefix) {
+			a.malformed(v)
+			continue
+		}
+		user := v[0][len(a.userPrefix):]
+		d.UserRoles[user] = append(d.UserRoles[user], v[1][len(a.rolePrefix):])
+	}
+	for _, v := range roleParents {
+		if !strings.HasPrefix(v[1], a.rolePrefix) {
+			a.malformed(v)
+			continue
+		}
+		role := v[0][len(a.rolePrefix):]
+		d.RoleParents[role] = append(d.RoleParents[role], v[1][len(a.rolePrefix):])
+	}
+	for _, v := range policies {
+		p, ok := a.parsePermission(v)
+		if !ok {
+			continue
+		}
+		role := v[0][len(a.rolePrefix):]
+		d.RolePermissions[role] = append(d.RolePermissions[role], p)
+	}
+	for _, v := range conditions {
+		for _, p := range a.parseConditions([][]string{v}) {
+			role := v[0][len(a.rolePrefix):]
+			d.RoleConditions[role] = append(d.RoleConditions[role], p)
+		}
+	}
+	byRole := make(map[string][][]string)
+	for _, v := range scopes {
+		if !strings.HasPrefix(v[0], a.rolePrefix) {
+			a.malformed(v)
+			continue
+		}
+		byRole[v[0]] = append(byRole[v[0]], v)
+	}
+	for k, v := range byRole {
+		if ds, ok := a.parseDataScope(v); ok {
+			sort.Slice(ds.Depts, func(i, j int) bool { return ds.Depts[i] < ds.Depts[j] })
+			d.RoleDataScopes[k[len(a.rolePrefix):]] = ds
+		}
+	}
+
+	for _, v := range d.UserRoles {
+		sort.Strings(v)
+	}
+	for _, v := range d.RoleParents {
+		sort.Strings(v)
+	}
+	for _, v := range d.RolePermissions {
+		sort.Slice(v, func(i, j int) bool {
+			return ruleKey([]string{v[i].Obj, v[i].Act, string(v[i].Eft)}) <
+				ruleKey([]string{v[j].Obj, v[j].Act, string(v[j].Eft)})
+		})
+	}
+	for _, v := range d.RoleConditions {
+		sort.Slice(v, func(i, j int) bool {
+			return ruleKey([]string{v[i].Obj, v[i].Act, v[i].Cond}) <
+				ruleKey([]string{v[j].Obj, v[j].Act, v[j].Cond})
+		})
+	}
+	return d
+}
+
+func (a *AuthServer) policyRules(d *PolicyData) (groupings [][]string,
+	policies [][]string, conditions [][]string, scopes [][]string, err error) {
+
+	for k, v := range d.UserRoles {
+		groupings = append(groupings, a.userRoleRules(k, v)...)
+	}
+	for k, v := range d.RoleParents {
+		groupings = append(groupings, a.roleParentRules(k, v)...)
+	}
+	for k, v := range d.RolePermissions {
+		rules, err := a.rolePermissionRules(k, v)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		policies = append(policies, rules...)
+	}
+	for k, v := range d.RoleConditions {
+		rules, err := a.roleConditionRules(k, v)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		conditions = append(conditions, rules...)
+	}
+	for k, v := range d.RoleDataScopes {
+		rules, err := a.roleDataScopeRules(k, v)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		scopes = append(scopes, rules...)
+	}
+	return
+}
+
+// splitGroupings separates the user to role rules from the role to role
+// rules.
+func (a *AuthServer) splitGroupings(rules [][]string) (userRoles [][]string,
+	roleParents [][]string) {
+
+	for _, v := range rules {
+		if strings.HasPrefix(v[0], a.rolePrefix) {
+			roleParents = append(roleParents, v)
+		} else {
+			userRoles = append(userRoles, v)
+		}
+	}
+	return
+}
+
+func subtractRules(rules [][]string, removed [][]string) (left [][]string) {
+	set := make(map[string]struct{}, len(removed))
+	for _, v := range removed {
+		set[ruleKey(v)] = struct{}{}
+	}
+	for _, v := range rules {
+		if _, ok := set[ruleKey(v)]; !ok {
+			left = append(left, v)
+		}
+	}
+	return
+}
+
+// hasCycle reports whether the edges from v[0] to v[1] form a cycle.
+func hasCycle(edges [][]string) bool {
+	next := make(map[string][]string)
+	for _, v := range edges {
+		next[v[0]] = append(next[v[0]], v[1])
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	var visit func(string) bool
+	visit = func(n string) bool {
+		state[n] = visiting
+		for _, v := range next[n] {
+			if state[v] == visiting || (state[v] == 0 && visit(v)) {
+				return true
+			}
+		}
+		state[n] = done
+		return false
+	}
+	for n := range next {
+		if state[n] == 0 && visit(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode writes the data as YAML, or as CSV rows such as
+//
+//	user_role,alice,admin
+//	role_parent,admin,staff
+//	permission,admin,GET:/api/v1/user,Allow,allow
+//	condition,editor,document,write,r2.user.Dept == r2.res.Dept
+//	data_scope,sales,custom,10,11
+func (d *PolicyData) Encode(w io.Writer, f Format) error {
+	switch f {
+	case FormatYAML:
+		return yaml.NewEncoder(w).Encode(d)
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		cw.WriteAll(d.csvRecords())
+		return cw.Error()
+	}
+	return ErrUnknownFormat
+}
+
+func DecodePolicyData(r io.Reader, f Format) (d *PolicyData, err error) {
+	d = &PolicyData{}
+	switch f {
+	case FormatYAML:
+		err = yaml.NewDecoder(r).Decode(d)
+		if err == io.EOF {
+			err = nil
+		}
+		return
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		cr.TrimLeadingSpace = true
+		records, err := cr.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		return d, d.fromCSVRecords(records)
+	}
+	return nil, ErrUnknownFormat
+}
+
+func (d *PolicyData) csvRecords() (records [][]string) {
+	for _, k := range sortedKeys(d.UserRoles) {
+		for _, v := range d.UserRoles[k] {
+			records = append(records, []string{csvUserRole, k, v})
+		}
+	}
+	for _, k := range sortedKeys(d.RoleParents) {
+		for _, v := range d.RoleParents[k] {
+			records = append(records, []string{csvRoleParent, k, v})
+		}
+	}
+	roles := make([]string, 0, len(d.RolePermissions))
+	for k := range d.RolePermissions {
+		roles = append(roles, k)
+	}
+	sort.Strings(roles)
+	for _, k := range roles {
+		for _, v := range d.RolePermissions[k] {
+			records = append(records,
+				[]string{csvPermission, k, v.Obj, v.Act, string(v.Eft)})
+		}
+	}
+	roles = roles[:0]
+	for k := range d.RoleConditions {
+		roles = append(roles, k)
+	}
+	sort.Strings(roles)
+	for _, k := range roles {
+		for _, v := range d.RoleConditions[k] {
+			records = append(records,
+				[]string{csvCondition, k, v.Obj, v.Act, v.Cond})
+		}
+	}
+	roles = roles[:0]
+	for k := range d.RoleDataScopes {
+		roles = append(roles, k)
+	}
+	sort.Strings(roles)
+	for _, k := range roles {
+		ds := d.RoleDataScopes[k]
+		record := []string{csvDataScope, k, string(ds.Scope)}
+		for _, v := range ds.Depts {
+			record = append(record, strconv.FormatInt(int64(v), 10))
+		}
+		records = append(records, record)
+	}
+	return
+}
+
+func (d *PolicyData) fromCSVRecords(records [][]string) error {
+	d.UserRoles = make(map[string][]string)
+	d.RoleParents = make(map[string][]string)
+	d.RolePermissions = make(map[string][]Permission)
+	d.RoleConditions = make(map[string][]ConditionalPermission)
+	d.RoleDataScopes = make(map[string]RoleDataScope)
+	for k, v := range records {
+		switch {
+		case len(v) == 3 && v[0] == csvUserRole:
+			d.UserRoles[v[1]] = append(d.UserRoles[v[1]], v[2])
+		case len(v) == 3 && v[0] == csvRoleParent:
+			d.RoleParents[v[1]] = append(d.RoleParents[v[1]], v[2])
+		case len(v) >= 4 && v[0] == csvPermission:
+			p := Permission{Obj: v[2], Act: v[3], Eft: EffectAllow}
+			if len(v) > 4 && v[4] != "" {
+				p.Eft = Effect(v[4])
+			}
+			d.RolePermissions[v[1]] = append(d.RolePermissions[v[1]], p)
+		case len(v) == 5 && v[0] == csvCondition:
+			d.RoleConditions[v[1]] = append(d.RoleConditions[v[1]],
+				ConditionalPermission{Obj: v[2], Act: v[3], Cond: v[4]})
+		case len(v) >= 3 && v[0] == csvDataScope:
+			ds := RoleDataScope{Scope: DataScope(v[2])}
+			for _, v1 := range v[3:] {
+				dept, err := strconv.ParseInt(v1, 10, 32)
+				if err != nil {
+					return fmt.Errorf("invalid department at line %d: %v", k+1, v)
+				}
+				ds.Depts = append(ds.Depts, int32(dept))
+			}
+			d.RoleDataScopes[v[1]] = ds
+		default:
+			return fmt.Errorf("invalid policy record at line %d: %v", k+1, v)
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
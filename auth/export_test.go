@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestHasCycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		edges [][]string
+		want  bool
+	}{
+		{"none", nil, false},
+		{"chain", [][]string{{"a", "b"}, {"b", "c"}, {"c", "d"}}, false},
+		{"diamond", [][]string{{"a", "b"}, {"a", "c"}, {"b", "d"}, {"c", "d"}}, false},
+		{"self", [][]string{{"a", "a"}}, true},
+		{"pair", [][]string{{"a", "b"}, {"b", "a"}}, true},
+		{"long", [][]string{{"a", "b"}, {"b", "c"}, {"c", "d"}, {"d", "b"}}, true},
+		{"apart", [][]string{{"a", "b"}, {"x", "y"}, {"y", "z"}, {"z", "x"}}, true},
+	}
+	for _, v := range tests {
+		if got := hasCycle(v.edges); got != v.want {
+			t.Errorf("%s: hasCycle() = %v, want %v", v.name, got, v.want)
+		}
+	}
+}
+
+func TestPolicyDataCSV(t *testing.T) {
+	d := &PolicyData{
+		UserRoles:   map[string][]string{"alice": {"admin", "staff"}},
+		RoleParents: map[string][]string{"admin": {"staff"}},
+		RolePermissions: map[string][]Permission{
+			"admin": {{Obj: "GET:/api/v1/user", Act: "Allow", Eft: EffectDeny}},
+		},
+		RoleConditions: map[string][]ConditionalPermission{
+			"editor": {{Obj: "document", Act: "write", Cond: "r2.user.Dept == r2.res.Dept"}},
+		},
+		RoleDataScopes: map[string]RoleDataScope{
+			"sales": {Scope: ScopeCustom, Depts: []int32{10, 11}},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := d.Encode(&buf, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodePolicyData(&buf, FormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, d) {
+		t.Errorf("DecodePolicyData() = %+v, want %+v", got, d)
+	}
+
+	for _, v := range []string{
+		"user_role,alice",
+		"data_scope,sales,custom,x",
+		"unknown,a,b",
+	} {
+		if _, err = DecodePolicyData(bytes.NewBufferString(v), FormatCSV); err == nil {
+			t.Errorf("DecodePolicyData(%q) succeeded", v)
+		}
+	}
+}
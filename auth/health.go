@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+)
+
+// FailMode decides Enforce when the policies cannot be trusted, that is
+// when AuthServer reaches neither redis nor the database, or AuthClient
+// does not reach redis, or the enforcer fails.
+type FailMode int
+
+const (
+	// Decide by the policies in memory, which may be stale
+	FailStale FailMode = iota
+	// Allow every request
+	FailOpen
+	// Deny every request
+	FailClosed
+)
+
+const (
+	defaultHealthInterval = 5 * time.Second
+	// consecutive redis failures which open the circuit
+	breakerThreshold = 3
+	// how often redis is probed while the circuit is open
+	breakerCooldown = 30 * time.Second
+	pingTimeout     = 2 * time.Second
+)
+
+var ErrRedisUnavailable = errors.New("redis is unavailable, the circuit is open")
+
+type AdapterHealth struct {
+	Healthy   bool
+	Failures  int // consecutive failures
+	LastErr   error
+	CheckedAt time.Time
+}
+
+// Health is the state of the adapters. While the circuit is open redis is
+// not used at all, AuthServer reads the database enforcer and queues the
+// writes of redis, until a probe succeeds and a sync catches redis up.
+// AuthClient does not use the database, whose health is always good.
+type Health struct {
+	Redis       AdapterHealth
+	DB          AdapterHealth
+	CircuitOpen bool
+}
+
+type healthState struct {
+	mu     sync.Mutex
+	health Health
+	// called when the circuit is closed again
+	onRecover func()
+}
+
+func newHealthState(onRecover func()) *healthState {
+	return &healthState{
+		health: Health{
+			Redis: AdapterHealth{Healthy: true},
+			DB:    AdapterHealth{Healthy: true},
+		},
+		onRecover: onRecover,
+	}
+}
+
+func (h *healthState) get() Health {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.health
+}
+
+func (h *healthState) redisUp() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.health.CircuitOpen
+}
+
+func (h *healthState) dbUp() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.health.DB.Healthy
+}
+
+func (h *healthState) reportRedis(err error) {
+	h.mu.Lock()
+	recovered := report(&h.health.Redis, err) && h.health.CircuitOpen
+	if err == nil {
+		h.health.CircuitOpen = false
+	} else if h.health.Redis.Failures >= breakerThreshold {
+		h.health.CircuitOpen = true
+	}
+	h.mu.Unlock()
+
+	if recovered && h.onRecover != nil {
+		h.onRecover()
+	}
+}
+
+func (h *healthState) reportDB(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	report(&h.health.DB, err)
+}
+
+// report records a check of the adapter, and reports whether it succeeded.
+func report(ah *AdapterHealth, err error) bool {
+	ah.CheckedAt = time.Now()
+	ah.LastErr = err
+	if err != nil {
+		ah.Healthy = false
+		ah.Failures++
+		return false
+	}
+	ah.Healthy = true
+	ah.Failures = 0
+	return true
+}
+
+// watch probes the adapters in background, less often while the circuit
+// is open so that a dead redis is not hammered.
+func (h *healthState) watch(pingRedis func(context.Context) error,
+	pingDB func(context.Context) error) {
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		h.reportRedis(pingRedis(ctx))
+		if pingDB != nil {
+			h.reportDB(pingDB(ctx))
+		}
+		cancel()
+
+		if h.redisUp() {
+			time.Sleep(defaultHealthInterval)
+		} else {
+			time.Sleep(breakerCooldown)
+		}
+	}
+}
+
+// decide applies the fail mode to the decision of an enforcer which cannot
+// be trusted.
+func (m FailMode) decide(b bool, err error) bool {
+	switch m {
+	case FailOpen:
+		return true
+	case FailClosed:
+		return false
+	}
+	return b && err == nil
+}
+
+func (a *AuthServer) Health() Health {
+	return a.health.get()
+}
+
+// reader returns the enforcer which serves the reads, the database
+// enforcer while the circuit of redis is open.
+func (a *AuthServer) reader() *casbin.SyncedEnforcer {
+	// the read only server has no redis
+	if a.e[1] != nil && a.health.redisUp() {
+		return a.e[1]
+	}
+	return a.e[0]
+}
+
+func (a *AuthServer) pingDB(ctx context.Context) error {
+	db, err := a.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
+}
+
+func (a *AuthClient) Health() Health {
+	return a.health.get()
+}
+
+// reload reloads the policies, since the changes published while redis
+// was unavailable are lost.
+func (a *AuthClient) reload() {
+	if err := a.e.LoadPolicy(); err != nil {
+		a.health.reportRedis(err)
+	}
+	if a.cache != nil {
+		a.cache.invalidate()
+	}
+}
+
+func (w *policyWatcher) ping(ctx context.Context) error {
+	return w.redis.Ping(ctx).Err()
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/utils"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"github.com/wheelergeo/g-otter-pkg/token"
+)
+
+// Only for hertz
+type ObjectFunc func(*app.RequestContext) string
+
+type MWConfig struct {
+	ErrMsg  string
+	ErrCode int
+	// Routes skipped by the check, such as POST:/api/v1/login
+	Public []string
+	// Objects of the routes which are not named by ObjectFunc, see Route
+	// and Object
+	Objects map[string]string
+	// Names the object of a request, RouteObject by default
+	ObjectFunc ObjectFunc
+	// Checks the requests, AuthClient by default, or AuthServer in the
+	// processes which create the server instead
+	Enforcer Enforcer
+}
+
+// ObjectKey keeps the object checked by the middleware in the request
+// context.
+const ObjectKey = "auth.object"
+
+// objects maps the routes given to Object to their objects.
+var objects sync.Map
+
+// Object names the object of a route, overriding MWConfig.Objects and
+// ObjectFunc, path is the full path as registered, such as
+//
+//	h.GET("/api/v1/user/:id", getUser)
+//	auth.Object(consts.MethodGet, "/api/v1/user/:id", "user:read")
+func Object(method string, path string, obj string) {
+	objects.Store(Route(method, path), obj)
+}
+
+// Route returns the key of a route in MWConfig.Public and MWConfig.Objects,
+// path is the full path as registered, such as /api/v1/user/:id.
+func Route(method string, path string) string {
+	return method + ":" + path
+}
+
+// RouteObject names the object of a request after its route, in the form
+// used by the limiter, such as GET:/api/v1/user/:id.
+func RouteObject(ctx *app.RequestContext) string {
+	return Route(string(ctx.Method()), ctx.FullPath())
+}
+
+// GenerateMiddleware checks every request with MWConfig.Enforcer, the user
+// is read from token.GetContext, so the middleware must be used after the
+// one which parses the token.
+func GenerateMiddleware(cfg MWConfig) app.HandlerFunc {
+	public := make(map[string]struct{}, len(cfg.Public))
+	for _, v := range cfg.Public {
+		public[v] = struct{}{}
+	}
+	objectFunc := cfg.ObjectFunc
+	if objectFunc == nil {
+		objectFunc = RouteObject
+	}
+
+	return func(c context.Context, ctx *app.RequestContext) {
+		route := RouteObject(ctx)
+		if _, ok := public[route]; ok {
+			ctx.Next(c)
+			return
+		}
+
+		userCtx := token.GetContext(c).UserCtx
+		if userCtx == nil {
+			ctx.AbortWithStatusJSON(consts.StatusUnauthorized, utils.H{
+				"err":  cfg.ErrMsg,
+				"code": cfg.ErrCode,
+			})
+			return
+		}
+
+		var obj string
+		if v, ok := objects.Load(route); ok {
+			obj = v.(string)
+		} else if obj, ok = cfg.Objects[route]; !ok {
+			obj = objectFunc(ctx)
+		}
+		ctx.Set(ObjectKey, obj)
+		if !enforceWith(cfg.Enforcer, strconv.FormatInt(userCtx.Id, 10), obj) {
+			ctx.AbortWithStatusJSON(consts.StatusForbidden, utils.H{
+				"err":  cfg.ErrMsg,
+				"code": cfg.ErrCode,
+			})
+			return
+		}
+		ctx.Next(c)
+	}
+}
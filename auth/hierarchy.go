@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"errors"
+
+	"github.com/casbin/casbin/v2"
+)
+
+var ErrRoleCycle = errors.New("the role inheritance would form a cycle")
+
+// AddParentsForRole makes the role inherit the permissions of the parent
+// roles, such as a post inheriting the roles of its department.
+func (a *AuthServer) AddParentsForRole(role string, parents []string) (err error) {
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+
+	for _, v := range parents {
+		if v == role || inherits(a.e[0], a.rolePrefix+v, a.rolePrefix+role) {
+			return ErrRoleCycle
+		}
+	}
+	return a.commitLocked(addOp("g", "g", a.roleParentRules(role, parents)))
+}
+
+func (a *AuthServer) DeleteParentsForRole(role string, parents []string) (err error) {
+	return a.commit(removeOp("g", "g", a.roleParentRules(role, parents)))
+}
+
+// GetParentsForRole returns the roles which the role inherits directly.
+func (a *AuthServer) GetParentsForRole(role string) (parents []string, err error) {
+	parents, err = a.reader().GetRolesForUser(a.rolePrefix + role)
+	if err != nil {
+		parents, err = a.e[0].GetRolesForUser(a.rolePrefix + role)
+		a.requestSync()
+	}
+	parents = a.trimRoles(parents)
+	return
+}
+
+// GetImplicitRolesForUser returns the roles of the user, together with all
+// the roles which they inherit.
+func (a *AuthServer) GetImplicitRolesForUser(user string) (roles []string, err error) {
+	roles, err = a.reader().GetImplicitRolesForUser(a.userPrefix + user)
+	if err != nil {
+		roles, err = a.e[0].GetImplicitRolesForUser(a.userPrefix + user)
+		a.requestSync()
+	}
+	roles = a.trimRoles(roles)
+	return
+}
+
+// GetImplicitPermissionsForUser returns the permissions of all the roles
+// returned by GetImplicitRolesForUser.
+func (a *AuthServer) GetImplicitPermissionsForUser(user string) (perms []Permission) {
+	roles, err := a.GetImplicitRolesForUser(user)
+	if err != nil {
+		return
+	}
+	for _, v := range roles {
+		perms = append(perms, a.GetPermissionsForRole(v)...)
+	}
+	return
+}
+
+func (a *AuthServer) roleParentRules(role string, parents []string) (rules [][]string) {
+	for _, v := range parents {
+		rules = append(rules, []string{a.rolePrefix + role, a.rolePrefix + v})
+	}
+	return
+}
+
+func (a *AuthClient) GetImplicitRolesForUser(user string) (roles []string, err error) {
+	roles, err = a.e.GetImplicitRolesForUser(a.userPrefix + user)
+	roles = a.trimRoles(roles)
+	return
+}
+
+func (a *AuthClient) GetImplicitPermissionsForUser(user string) (perms []Permission) {
+	roles, err := a.GetImplicitRolesForUser(user)
+	if err != nil {
+		return
+	}
+	for _, v := range roles {
+		perms = append(perms, a.GetPermissionsForRole(v)...)
+	}
+	return
+}
+
+// inherits reports whether name reaches target through the grouping rules,
+// walking the rules rather than the role manager so that the depth is not
+// limited.
+func inherits(e *casbin.SyncedEnforcer, name string, target string) bool {
+	return roleChain(e, name, target) != nil
+}
+
+// roleChain returns the shortest path of the grouping rules from name to
+// target, not including name, or nil when target is not reached.
+func roleChain(e *casbin.SyncedEnforcer, name string, target string) []string {
+	prev := map[string]string{name: ""}
+	queue := []string{name}
+	for len(queue) != 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, v := range e.GetFilteredGroupingPolicy(0, cur) {
+			if _, ok := prev[v[1]]; ok {
+				continue
+			}
+			prev[v[1]] = cur
+			if v[1] != target {
+				queue = append(queue, v[1])
+				continue
+			}
+
+			var chain []string
+			for n := target; n != name; n = prev[n] {
+				chain = append([]string{n}, chain...)
+			}
+			return chain
+		}
+	}
+	return nil
+}
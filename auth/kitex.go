@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/bytedance/gopkg/cloud/metainfo"
+	"github.com/cloudwego/kitex/pkg/endpoint"
+	"github.com/cloudwego/kitex/pkg/kerrors"
+	"github.com/cloudwego/kitex/pkg/rpcinfo"
+	"github.com/wheelergeo/g-otter-pkg/constants"
+	"github.com/wheelergeo/g-otter-pkg/token"
+)
+
+// Only for kitex
+type RPCObjectFunc func(context.Context) string
+
+const DefaultCallerKey = "USER_ID"
+
+type KitexMWConfig struct {
+	// Methods skipped by the check, see Method
+	Public []string
+	// Objects of the methods which are not named by ObjectFunc
+	Objects map[string]string
+	// Names the object of a call, MethodObject by default
+	ObjectFunc RPCObjectFunc
+	// The caller is the user of token.GetContext. Without it, the user id
+	// transmitted by metainfo under CallerKey, DefaultCallerKey by default,
+	// is used when TrustMetainfo is set. Any client which can set the
+	// headers may claim any user by metainfo, so only trust it when all
+	// the callers are services inside the mesh.
+	CallerKey     string
+	TrustMetainfo bool
+	// Checks the calls, AuthClient by default, or AuthServer in the
+	// processes which create the server instead
+	Enforcer Enforcer
+}
+
+// Method returns the key of a method in KitexMWConfig.Public and
+// KitexMWConfig.Objects.
+func Method(service string, method string) string {
+	return service + "/" + method
+}
+
+// MethodObject names the object of a call after the service and method,
+// such as UserService/GetUser.
+func MethodObject(ctx context.Context) string {
+	ri := rpcinfo.GetRPCInfo(ctx)
+	if ri == nil {
+		return ""
+	}
+	return Method(ri.Invocation().ServiceName(), ri.Invocation().MethodName())
+}
+
+// GenerateKitexMiddleware checks every call with KitexMWConfig.Enforcer.
+// Rejected calls return a kerrors.BizStatusErrorIface with the codes of
+// the constants package, the server needs a meta handler which transmits
+// business errors, such as transmeta.ServerTTHeaderHandler.
+func GenerateKitexMiddleware(cfg KitexMWConfig) endpoint.Middleware {
+	public := make(map[string]struct{}, len(cfg.Public))
+	for _, v := range cfg.Public {
+		public[v] = struct{}{}
+	}
+	objectFunc := cfg.ObjectFunc
+	if objectFunc == nil {
+		objectFunc = MethodObject
+	}
+	callerKey := cfg.CallerKey
+	if callerKey == "" {
+		callerKey = DefaultCallerKey
+	}
+
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, req, resp interface{}) (err error) {
+			method := MethodObject(ctx)
+			if _, ok := public[method]; ok {
+				return next(ctx, req, resp)
+			}
+
+			user, ok := callerOf(ctx, callerKey, cfg.TrustMetainfo)
+			if !ok {
+				return kerrors.NewBizStatusError(
+					constants.UnknownCaller, constants.UnknownCallerMsg)
+			}
+
+			obj, ok := cfg.Objects[method]
+			if !ok {
+				obj = objectFunc(ctx)
+			}
+			if !enforceWith(cfg.Enforcer, user, obj) {
+				return kerrors.NewBizStatusError(
+					constants.PermissionDenied, constants.PermissionDeniedMsg)
+			}
+			return next(ctx, req, resp)
+		}
+	}
+}
+
+func callerOf(ctx context.Context, key string,
+	trustMetainfo bool) (user string, ok bool) {
+
+	// the verified token goes first
+	if userCtx := token.GetContext(ctx).UserCtx; userCtx != nil {
+		return strconv.FormatInt(userCtx.Id, 10), true
+	}
+	if !trustMetainfo {
+		return
+	}
+	if user, ok = metainfo.GetPersistentValue(ctx, key); ok {
+		return
+	}
+	return metainfo.GetValue(ctx, key)
+}
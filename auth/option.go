@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/casbin/casbin/v2/model"
+	"gorm.io/gorm"
+)
+
+// naming is how users, roles and objects are written in the policies.
+type naming struct {
+	userPrefix   string
+	rolePrefix   string
+	policyPrefix string
+	action       string
+	onMalformed  func(rule []string)
+}
+
+type options struct {
+	naming
+	cacheSize        int
+	auditDB          *gorm.DB
+	auditTable       string
+	denialSampleRate float64
+	failMode         FailMode
+}
+
+type Option func(*options)
+
+func defaultOptions() options {
+	return options{
+		naming: naming{
+			userPrefix:   "u_",
+			rolePrefix:   "r_",
+			policyPrefix: "p_",
+			action:       "Allow",
+		},
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := defaultOptions()
+	for _, v := range opts {
+		v(&o)
+	}
+	if err := o.validate(); err != nil {
+		panic(err)
+	}
+	return o
+}
+
+func WithUserPrefix(prefix string) Option {
+	return func(o *options) {
+		o.userPrefix = prefix
+	}
+}
+
+func WithRolePrefix(prefix string) Option {
+	return func(o *options) {
+		o.rolePrefix = prefix
+	}
+}
+
+func WithPolicyPrefix(prefix string) Option {
+	return func(o *options) {
+		o.policyPrefix = prefix
+	}
+}
+
+// WithAction sets the action checked by Enforce and granted by
+// AddPoliciesForRole.
+func WithAction(action string) Option {
+	return func(o *options) {
+		o.action = action
+	}
+}
+
+// WithMalformedHandler is called with every stored rule which is skipped
+// because it does not carry the expected prefixes.
+func WithMalformedHandler(f func(rule []string)) Option {
+	return func(o *options) {
+		o.onMalformed = f
+	}
+}
+
+// WithDecisionCache makes AuthClient keep up to size results of Enforce,
+// they are dropped whenever the policies change.
+func WithDecisionCache(size int) Option {
+	return func(o *options) {
+		o.cacheSize = size
+	}
+}
+
+// WithAuditDB sets where the audit logs are written, AuthServer writes them
+// to the policy table suffixed with _audit by default, and AuthClient
+// writes none without it.
+func WithAuditDB(db *gorm.DB, table string) Option {
+	return func(o *options) {
+		o.auditDB = db
+		o.auditTable = table
+	}
+}
+
+// WithDenialSampling records the given fraction of the denied requests to
+// the audit logs, 0 records none and 1 records all of them.
+func WithDenialSampling(rate float64) Option {
+	return func(o *options) {
+		o.denialSampleRate = rate
+	}
+}
+
+// WithFailMode sets how Enforce decides when the policies cannot be
+// trusted, FailStale by default.
+func WithFailMode(m FailMode) Option {
+	return func(o *options) {
+		o.failMode = m
+	}
+}
+
+func (o *options) validate() error {
+	if o.userPrefix == "" || o.rolePrefix == "" {
+		return errors.New("user and role prefixes must not be empty")
+	}
+	// users and roles are told apart by the prefix
+	if strings.HasPrefix(o.userPrefix, o.rolePrefix) ||
+		strings.HasPrefix(o.rolePrefix, o.userPrefix) {
+		return fmt.Errorf("user prefix %q and role prefix %q overlap",
+			o.userPrefix, o.rolePrefix)
+	}
+	if o.action == "" {
+		return errors.New("action must not be empty")
+	}
+	if o.denialSampleRate < 0 || o.denialSampleRate > 1 {
+		return errors.New("denial sampling rate must be between 0 and 1")
+	}
+	if o.auditDB != nil && o.auditTable == "" {
+		return errors.New("audit table must not be empty")
+	}
+	return nil
+}
+
+// validateModel checks that the model takes the requests and stores the
+// policies the way AuthServer and AuthClient write them.
+func validateModel(m model.Model) error {
+	r, ok := m["r"]["r"]
+	if !ok || !equalTokens(r.Tokens, "r_sub", "r_obj", "r_act") {
+		return errors.New("invalid model: request must be r = sub, obj, act")
+	}
+
+	p, ok := m["p"]["p"]
+	if !ok || !(equalTokens(p.Tokens, "p_sub", "p_obj", "p_act") ||
+		equalTokens(p.Tokens, "p_sub", "p_obj", "p_act", "p_eft")) {
+		return errors.New(
+			"invalid model: policy must be p = sub, obj, act[, eft]")
+	}
+
+	g, ok := m["g"]["g"]
+	if !ok || strings.Count(g.Value, "_") != 2 {
+		return errors.New("invalid model: role must be g = _, _")
+	}
+
+	if _, ok = m["e"]["e"]; !ok {
+		return errors.New("invalid model: policy effect is missing")
+	}
+	if _, ok = m["m"]["m"]; !ok {
+		return errors.New("invalid model: matchers are missing")
+	}
+
+	if _, err := hasABAC(m); err != nil {
+		return err
+	}
+	_, err := hasDataScope(m)
+	return err
+}
+
+func equalTokens(tokens []string, expected ...string) bool {
+	if len(tokens) != len(expected) {
+		return false
+	}
+	for k, v := range tokens {
+		if v != expected[k] {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *naming) malformed(rule []string) {
+	if n.onMalformed != nil {
+		n.onMalformed(rule)
+	}
+}
+
+// trimRoles strips the role prefix, and skips the names without it.
+func (n *naming) trimRoles(roles []string) (trimmed []string) {
+	for _, v := range roles {
+		if !strings.HasPrefix(v, n.rolePrefix) {
+			n.malformed([]string{v})
+			continue
+		}
+		trimmed = append(trimmed, v[len(n.rolePrefix):])
+	}
+	return
+}
+
+func (n *naming) parsePermission(rule []string) (p Permission, ok bool) {
+	if len(rule) < 3 || !strings.HasPrefix(rule[0], n.rolePrefix) ||
+		!strings.HasPrefix(rule[1], n.policyPrefix) {
+		n.malformed(rule)
+		return
+	}
+
+	p = Permission{
+		Obj: rule[1][len(n.policyPrefix):],
+		Act: rule[2],
+		Eft: EffectAllow,
+	}
+	if len(rule) > 3 {
+		p.Eft = Effect(rule[3])
+	}
+	return p, true
+}
+
+func (n *naming) parsePermissions(rules [][]string) (perms []Permission) {
+	for _, v := range rules {
+		if p, ok := n.parsePermission(v); ok {
+			perms = append(perms, p)
+		}
+	}
+	return
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	_ "embed"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+)
+
+// DefaultModel is used when NewServer or NewClient is given no model path,
+// it denies over allows, supports ABAC and data scopes, and matches the
+// objects by objMatch.
+//
+//go:embed model.conf
+var DefaultModel string
+
+const (
+	// Objects starting with it are shell patterns, such as glob:GET:/api/v?/user
+	GlobPrefix = "glob:"
+	// Objects starting with it are regular expressions, such as
+	// re:^GET:/api/v1/(user|dept)/.*$
+	RegexPrefix = "re:"
+)
+
+// ErrObjectTooLong is returned for the objects, patterns included, which
+// do not fit in the columns of the policy table.
+var ErrObjectTooLong = fmt.Errorf("the object must not be longer than %d bytes", MaxFieldLength)
+
+var regexCache sync.Map
+
+// MatchObject reports whether obj is matched by the object of a policy,
+// which is one of
+//
+//	GET:/api/v1/user/:id   the object itself
+//	GET:/api/v1/user/*     the objects starting with GET:/api/v1/user/
+//	glob:GET:/api/v?/user  the objects matching the shell pattern
+//	re:^GET:/api/v1/.*$    the objects matching the regular expression
+//
+// A model matches the objects this way by objMatch(r.obj, p.obj). Patterns
+// are stored as objects, so with the prefix of the policies they are at
+// most MaxFieldLength bytes long.
+func MatchObject(pattern string, obj string) bool {
+	switch {
+	case strings.HasPrefix(pattern, RegexPrefix):
+		re, err := compileRegex(pattern[len(RegexPrefix):])
+		return err == nil && re.MatchString(obj)
+	case strings.HasPrefix(pattern, GlobPrefix):
+		ok, err := path.Match(pattern[len(GlobPrefix):], obj)
+		return err == nil && ok
+	}
+
+	i := strings.Index(pattern, "*")
+	if i == -1 || i != len(pattern)-1 {
+		return pattern == obj
+	}
+	return strings.HasPrefix(obj, pattern[:i])
+}
+
+// IsObjectPattern reports whether the object of a policy matches other
+// objects than itself.
+func IsObjectPattern(pattern string) bool {
+	return strings.HasPrefix(pattern, RegexPrefix) ||
+		strings.HasPrefix(pattern, GlobPrefix) ||
+		strings.HasSuffix(pattern, "*")
+}
+
+func compileRegex(expr string) (*regexp.Regexp, error) {
+	if v, ok := regexCache.Load(expr); ok {
+		return v.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	regexCache.Store(expr, re)
+	return re, nil
+}
+
+// loadModel reads the model at modelPath, or DefaultModel when it is empty.
+func loadModel(modelPath string) (model.Model, error) {
+	if modelPath == "" {
+		return model.NewModelFromString(DefaultModel)
+	}
+	return model.NewModelFromFile(modelPath)
+}
+
+// newEnforcer creates an enforcer which matches the objects by objMatch
+// after stripping the policy prefix.
+func (n *naming) newEnforcer(modelPath string, params ...interface{}) (
+	e *casbin.SyncedEnforcer, err error) {
+
+	m, err := loadModel(modelPath)
+	if err != nil {
+		return
+	}
+	e, err = casbin.NewSyncedEnforcer(append([]interface{}{m}, params...)...)
+	if err != nil {
+		return
+	}
+
+	e.AddFunction("objMatch", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return false, nil
+		}
+		obj, ok1 := args[0].(string)
+		pattern, ok2 := args[1].(string)
+		if !ok1 || !ok2 || !strings.HasPrefix(obj, n.policyPrefix) ||
+			!strings.HasPrefix(pattern, n.policyPrefix) {
+			return false, nil
+		}
+		return MatchObject(pattern[len(n.policyPrefix):], obj[len(n.policyPrefix):]), nil
+	})
+	return
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchObject(t *testing.T) {
+	tests := []struct {
+		pattern string
+		obj     string
+		want    bool
+	}{
+		{"GET:/api/v1/user", "GET:/api/v1/user", true},
+		{"GET:/api/v1/user", "GET:/api/v1/user/1", false},
+		{"GET:/api/v1/user/:id", "GET:/api/v1/user/1", false},
+
+		// a trailing * matches by prefix
+		{"GET:/api/v1/user/*", "GET:/api/v1/user/1", true},
+		{"GET:/api/v1/user/*", "GET:/api/v1/user/", true},
+		{"GET:/api/v1/user/*", "GET:/api/v1/user", false},
+		{"GET:/api/v1/user/*", "POST:/api/v1/user/1", false},
+		{"*", "anything", true},
+		// any other * is taken literally
+		{"GET:/api/*/user", "GET:/api/v1/user", false},
+		{"GET:/api/*/user", "GET:/api/*/user", true},
+
+		{"glob:GET:/api/v?/user", "GET:/api/v1/user", true},
+		{"glob:GET:/api/v?/user", "GET:/api/v10/user", false},
+		{"glob:GET:/api/*/user", "GET:/api/v1/user", true},
+		// * does not cross the separator
+		{"glob:GET:/api/*", "GET:/api/v1/user", false},
+		{"glob:GET:/api/v[12]/user", "GET:/api/v2/user", true},
+		{"glob:GET:/api/v[12]/user", "GET:/api/v3/user", false},
+		// malformed shell patterns match nothing
+		{"glob:GET:/api/v[1/user", "GET:/api/v[1/user", false},
+
+		{"re:^GET:/api/v1/(user|dept)/.*$", "GET:/api/v1/dept/1", true},
+		{"re:^GET:/api/v1/(user|dept)/.*$", "GET:/api/v1/role/1", false},
+		// unanchored expressions match anywhere
+		{"re:user", "GET:/api/v1/user/1", true},
+		// invalid expressions match nothing
+		{"re:^GET:/api/(user$", "GET:/api/(user", false},
+		{"re:[", "[", false},
+	}
+	for _, v := range tests {
+		if got := MatchObject(v.pattern, v.obj); got != v.want {
+			t.Errorf("MatchObject(%q, %q) = %v, want %v", v.pattern, v.obj, got, v.want)
+		}
+	}
+}
+
+func TestIsObjectPattern(t *testing.T) {
+	tests := map[string]bool{
+		"GET:/api/v1/user":      false,
+		"GET:/api/*/user":       false,
+		"GET:/api/v1/user/*":    true,
+		"glob:GET:/api/v?/user": true,
+		"re:^GET:/api/.*$":      true,
+	}
+	for k, v := range tests {
+		if got := IsObjectPattern(k); got != v {
+			t.Errorf("IsObjectPattern(%q) = %v, want %v", k, got, v)
+		}
+	}
+}
+
+func TestPermissionSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		perms []Permission
+		want  []Permission
+	}{
+		{
+			name: "denied by the object",
+			perms: []Permission{
+				{Obj: "user", Act: "read", Eft: EffectAllow},
+				{Obj: "user", Act: "read", Eft: EffectDeny},
+				{Obj: "dept", Act: "read", Eft: EffectAllow},
+			},
+			want: []Permission{{Obj: "dept", Act: "read", Eft: EffectAllow}},
+		},
+		{
+			name: "denied by a prefix",
+			perms: []Permission{
+				{Obj: "GET:/api/v1/user/:id", Act: "Allow", Eft: EffectAllow},
+				{Obj: "GET:/api/v1/dept", Act: "Allow", Eft: EffectAllow},
+				{Obj: "GET:/api/v1/user/*", Act: "Allow", Eft: EffectDeny},
+			},
+			want: []Permission{{Obj: "GET:/api/v1/dept", Act: "Allow", Eft: EffectAllow}},
+		},
+		{
+			name: "denied by a regular expression",
+			perms: []Permission{
+				{Obj: "GET:/api/v1/user", Act: "Allow", Eft: EffectAllow},
+				{Obj: "GET:/api/v1/dept", Act: "Allow", Eft: EffectAllow},
+				{Obj: "re:^GET:/api/v1/(user|role)$", Act: "Allow", Eft: EffectDeny},
+			},
+			want: []Permission{{Obj: "GET:/api/v1/dept", Act: "Allow", Eft: EffectAllow}},
+		},
+		{
+			name: "denied for another action",
+			perms: []Permission{
+				{Obj: "user", Act: "read", Eft: EffectAllow},
+				{Obj: "user", Act: "write", Eft: EffectDeny},
+			},
+			want: []Permission{{Obj: "user", Act: "read", Eft: EffectAllow}},
+		},
+		{
+			name: "distinct and sorted",
+			perms: []Permission{
+				{Obj: "user", Act: "write", Eft: EffectAllow},
+				{Obj: "dept", Act: "read", Eft: EffectAllow},
+				{Obj: "user", Act: "read", Eft: EffectAllow},
+				{Obj: "user", Act: "write", Eft: EffectAllow},
+			},
+			want: []Permission{
+				{Obj: "dept", Act: "read", Eft: EffectAllow},
+				{Obj: "user", Act: "read", Eft: EffectAllow},
+				{Obj: "user", Act: "write", Eft: EffectAllow},
+			},
+		},
+	}
+	for _, v := range tests {
+		if got := permissionSet(v.perms); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("%s: permissionSet() = %v, want %v", v.name, got, v.want)
+		}
+	}
+}
+
+func TestDefaultModelPatterns(t *testing.T) {
+	n := defaultOptions().naming
+	e, err := n.newEnforcer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range [][]string{
+		{"r_staff", "p_GET:/api/v1/*", "Allow", "allow"},
+		{"r_staff", "p_re:^GET:/api/v1/admin/.*$", "Allow", "deny"},
+		{"r_staff", "p_glob:POST:/api/v?/order", "Allow", "allow"},
+	} {
+		if _, err = e.AddPolicy(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = e.AddGroupingPolicy("u_1", "r_staff"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		obj  string
+		want bool
+	}{
+		{"GET:/api/v1/user", true},
+		{"GET:/api/v1/admin/user", false},
+		{"POST:/api/v2/order", true},
+		{"POST:/api/v1/user", false},
+		// the objects of the requests are never read as patterns
+		{"GET:/api/v1/*", true},
+		{"re:.*", false},
+	}
+	for _, v := range tests {
+		got, err := e.Enforce("u_1", "p_"+v.obj, "Allow")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v.want {
+			t.Errorf("Enforce(%q) = %v, want %v", v.obj, got, v.want)
+		}
+	}
+}
+
+func TestPermissionRuleLength(t *testing.T) {
+	obj := "p_re:^GET:/api/v1/" + strings.Repeat("a", MaxFieldLength)
+	if _, err := permissionRule("r_admin", obj, Permission{Act: "Allow"}, true); err != ErrObjectTooLong {
+		t.Errorf("permissionRule() error = %v, want %v", err, ErrObjectTooLong)
+	}
+	obj = "p_re:^GET:/api/v1/.*$"
+	if _, err := permissionRule("r_admin", obj, Permission{Act: "Allow"}, true); err != nil {
+		t.Errorf("permissionRule() error = %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/casbin/casbin/v2"
+)
+
+// Effect of a permission. Deny rules need a model with an eft field, such as
+//
+//	[policy_definition]
+//	p = sub, obj, act, eft
+//
+//	[policy_effect]
+//	e = some(where (p.eft == allow)) && !some(where (p.eft == deny))
+type Effect string
+
+const (
+	EffectAllow Effect = "allow"
+	EffectDeny  Effect = "deny"
+)
+
+// Permission is an action on an object, such as read, write and delete,
+// or a HTTP method.
+type Permission struct {
+	Obj string `json:"obj" yaml:"obj"`
+	Act string `json:"act" yaml:"act"`
+	Eft Effect `json:"eft,omitempty" yaml:"eft,omitempty"`
+}
+
+var (
+	ErrDenyUnsupported = errors.New("the model has no eft field for deny rules")
+	ErrInvalidEffect   = errors.New("the effect must be allow or deny")
+)
+
+// hasEffect reports whether the policies of the model carry an eft field.
+func hasEffect(e *casbin.SyncedEnforcer) bool {
+	p, ok := e.GetModel()["p"]["p"]
+	if !ok {
+		return false
+	}
+	for _, v := range p.Tokens {
+		if v == "p_eft" {
+			return true
+		}
+	}
+	return false
+}
+
+func permissionRule(sub string, obj string, p Permission,
+	withEft bool) (rule []string, err error) {
+
+	// any other effect would be stored but match neither allow nor deny
+	if p.Eft != "" && p.Eft != EffectAllow && p.Eft != EffectDeny {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidEffect, p.Eft)
+	}
+
+	if len(obj) > MaxFieldLength {
+		return nil, ErrObjectTooLong
+	}
+
+	rule = []string{sub, obj, p.Act}
+	if withEft {
+		eft := p.Eft
+		if eft == "" {
+			eft = EffectAllow
+		}
+		rule = append(rule, string(eft))
+	} else if p.Eft == EffectDeny {
+		err = ErrDenyUnsupported
+	}
+	return
+}
+
+// permissionSet returns the distinct allowed permissions sorted by object
+// and action. A permission denied by any rule is left out, also when the
+// rule denies it by a pattern.
+func permissionSet(perms []Permission) (set []Permission) {
+	var denied []Permission
+	for _, v := range perms {
+		if v.Eft == EffectDeny {
+			denied = append(denied, v)
+		}
+	}
+
+	seen := make(map[Permission]struct{}, len(perms))
+	for _, v := range perms {
+		if v.Eft == EffectDeny {
+			continue
+		}
+		if isDenied(denied, v) {
+			continue
+		}
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		set = append(set, v)
+	}
+
+	sort.Slice(set, func(i, j int) bool {
+		if set[i].Obj != set[j].Obj {
+			return set[i].Obj < set[j].Obj
+		}
+		return set[i].Act < set[j].Act
+	})
+	return
+}
+
+func isDenied(denied []Permission, p Permission) bool {
+	for _, v := range denied {
+		if v.Act == p.Act && MatchObject(v.Obj, p.Obj) {
+			return true
+		}
+	}
+	return false
+}
+
+// distinct removes the repeated strings and keeps the first occurrences in
+// order.
+func distinct(s []string) (d []string) {
+	seen := make(map[string]struct{}, len(s))
+	for _, v := range s {
+		if _, ok := seen[v]; !ok {
+			seen[v] = struct{}{}
+			d = append(d, v)
+		}
+	}
+	return
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/casbin/casbin/v2"
+	"gorm.io/gorm"
+)
+
+// GetAllRoles returns the roles which are granted, inherit or are inherited,
+// or have permissions, sorted by name.
+func (a *AuthServer) GetAllRoles() []string {
+	roles := a.allRoles(a.reader())
+	if len(roles) == 0 {
+		roles = a.allRoles(a.e[0])
+		if len(roles) != 0 {
+			a.requestSync()
+		}
+	}
+	return roles
+}
+
+func (a *AuthServer) allRoles(e *casbin.SyncedEnforcer) []string {
+	var names []string
+	for _, v := range e.GetGroupingPolicy() {
+		names = append(names, v...)
+	}
+	for _, v := range e.GetPolicy() {
+		names = append(names, v[0])
+	}
+	if a.withABAC {
+		for _, v := range e.GetNamedPolicy(abacPtype) {
+			names = append(names, v[0])
+		}
+	}
+
+	var roles []string
+	for _, v := range distinct(names) {
+		if strings.HasPrefix(v, a.rolePrefix) {
+			roles = append(roles, v[len(a.rolePrefix):])
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// GetUsersForRole returns the users granted the role directly, the roles
+// which inherit it are not included.
+func (a *AuthServer) GetUsersForRole(role string) (users []string, err error) {
+	names, err := a.reader().GetUsersForRole(a.rolePrefix + role)
+	if err != nil {
+		names, err = a.e[0].GetUsersForRole(a.rolePrefix + role)
+		a.requestSync()
+	}
+	for _, v := range names {
+		if strings.HasPrefix(v, a.userPrefix) {
+			users = append(users, v[len(a.userPrefix):])
+		}
+	}
+	return
+}
+
+// DeleteRole revokes the role from its users, removes its inheritance both
+// ways, and removes its permissions and data scope.
+func (a *AuthServer) DeleteRole(role string) (err error) {
+	role = a.rolePrefix + role
+
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+
+	groupings := append(a.e[0].GetFilteredGroupingPolicy(0, role),
+		a.e[0].GetFilteredGroupingPolicy(1, role)...)
+	ops := []policyOp{
+		removeOp("g", "g", groupings),
+		removeOp("p", "p", a.e[0].GetFilteredPolicy(0, role)),
+	}
+	if a.withABAC {
+		ops = append(ops, removeOp("p", abacPtype,
+			a.e[0].GetFilteredNamedPolicy(abacPtype, 0, role)))
+	}
+	if a.withDataScope {
+		ops = append(ops, removeOp("p", dataScopePtype,
+			a.e[0].GetFilteredNamedPolicy(dataScopePtype, 0, role)))
+	}
+	return a.commitLockedWith(func(tx *gorm.DB) ([]ExpiryChange, error) {
+		return a.deleteExpirations(tx, "role_name = ?", role[len(a.rolePrefix):])
+	}, ops...)
+}
@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"context"
+	"errors"
 	"sync"
 
 	"github.com/casbin/casbin/v2"
@@ -10,32 +12,52 @@ import (
 )
 
 type AuthServer struct {
-	e            [2]*casbin.Enforcer
-	userPrefix   string
-	rolePrefix   string
-	policyPrefix string
-	action       string
+	naming
+	e             [2]*casbin.SyncedEnforcer
+	model         string
+	withEft       bool
+	withABAC      bool
+	withDataScope bool
+	syncer        *syncState
+	outbox        *outbox
+	watcher       *policyWatcher
+	health        *healthState
+	failMode      FailMode
+	auditor       *auditor
+	actor         string
+	db            *gorm.DB
+	table         string
+	readOnly      bool
 }
 
 var once sync.Once
 var s *AuthServer
 
+var ErrReadOnly = errors.New("the server is read only")
+
+// modelPath may be empty for DefaultModel.
 func NewServer(modelPath string, policy_db *gorm.DB,
-	policy_table string, policy_redis string) {
+	policy_table string, policy_redis string, opts ...Option) {
 
 	once.Do(func() {
-		s = new(AuthServer)
-		s.userPrefix = "u_"
-		s.rolePrefix = "r_"
-		s.policyPrefix = "p_"
-		s.action = "Allow"
-		d, err := gormadapter.NewAdapterByDBUseTableName(
-			policy_db, "", policy_table)
+		o := newOptions(opts)
+		var err error
+		s, err = newDBServer(modelPath, policy_db, policy_table, o)
 		if err != nil {
 			panic(err)
 		}
-
-		s.e[0], err = casbin.NewEnforcer(modelPath, d)
+		// A sync catches redis up after it recovers
+		s.health = newHealthState(func() {
+			s.requestSync()
+		})
+		if err = s.migrateExpiry(); err != nil {
+			panic(err)
+		}
+		auditDB, auditTable := policy_db, policy_table+"_audit"
+		if o.auditDB != nil {
+			auditDB, auditTable = o.auditDB, o.auditTable
+		}
+		s.auditor, err = newAuditor(auditDB, auditTable, o.denialSampleRate)
 		if err != nil {
 			panic(err)
 		}
@@ -44,13 +66,33 @@ func NewServer(modelPath string, policy_db *gorm.DB,
 		if err != nil {
 			panic(err)
 		}
-		s.e[1], err = casbin.NewEnforcer(modelPath, r)
+		s.e[1], err = s.newEnforcer(modelPath, r)
 		if err != nil {
 			panic(err)
 		}
 
+		// Notify clients of every change written to redis
+		s.watcher, err = newPolicyWatcher(policy_redis, policyChannel)
+		if err != nil {
+			panic(err)
+		}
+		if err = s.e[1].SetWatcher(s.watcher); err != nil {
+			panic(err)
+		}
+
 		// Synchronize data between redis and mysql
-		s.Sync()
+		if err = s.Sync(); err != nil {
+			panic(err)
+		}
+		s.startReconcile(defaultReconcileInterval)
+		go s.retryOutbox()
+		go s.sweep(defaultSweepInterval)
+		go s.health.watch(s.watcher.ping, s.pingDB)
+
+		// Changes made by other servers are picked up by the next sync
+		s.watcher.SetUpdateCallback(func(string) {
+			s.requestSync()
+		})
 	})
 }
 
@@ -58,172 +100,205 @@ func Server() *AuthServer {
 	return s
 }
 
-func (a *AuthServer) Sync() {
-	// 1. Clear redis policy
-	a.e[1].LoadPolicy()
-	roles := a.e[1].GetAllRoles()
-	for _, v := range roles {
-		posts, err := a.e[1].GetUsersForRole(v)
-		if err != nil {
-			panic(err)
-		}
-		for _, v1 := range posts {
-			_, err = a.e[1].DeleteRoleForUser(v1, v)
-			if err != nil {
-				panic(err)
-			}
-		}
-	}
-	a.e[1].RemovePolicies(a.e[1].GetPolicy())
+// NewReadOnlyServer loads the policies of the database for reading, such
+// as Export and Import with DryRun. It creates no table, touches no redis
+// and runs nothing in background, every change returns ErrReadOnly. It is
+// not the one returned by Server.
+func NewReadOnlyServer(modelPath string, policy_db *gorm.DB,
+	policy_table string, opts ...Option) (*AuthServer, error) {
 
-	// 2. Synchronize roles
-	roles = a.e[0].GetAllRoles()
-	for _, v := range roles {
-		posts, err := a.e[0].GetUsersForRole(v)
-		if err != nil {
-			panic(err)
-		}
-		for _, v1 := range posts {
-			_, err = a.e[1].AddRoleForUser(v1, v)
-			if err != nil {
-				panic(err)
-			}
-		}
+	db := policy_db.WithContext(context.Background())
+	gormadapter.TurnOffAutoMigrate(db)
+	a, err := newDBServer(modelPath, db, policy_table, newOptions(opts))
+	if err != nil {
+		return nil, err
 	}
+	a.readOnly = true
+	a.health = newHealthState(nil)
+	return a, nil
+}
 
-	// 3. Synchronize policies
-	a.e[1].LoadPolicy()
-	policies := a.e[0].GetPolicy()
-	if len(policies) == 0 {
-		return
+// newDBServer creates the server with the database enforcer only.
+func newDBServer(modelPath string, policy_db *gorm.DB,
+	policy_table string, o options) (a *AuthServer, err error) {
+
+	a = &AuthServer{
+		naming:   o.naming,
+		model:    modelPath,
+		db:       policy_db,
+		table:    policy_table,
+		syncer:   new(syncState),
+		outbox:   new(outbox),
+		failMode: o.failMode,
 	}
-	_, err := a.e[1].AddPolicies(policies)
+	d, err := gormadapter.NewAdapterByDBUseTableName(
+		policy_db, "", policy_table)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-}
 
-func (a *AuthServer) AddRolesForUser(user string, roles []string) (err error) {
-	for k, v := range roles {
-		roles[k] = a.rolePrefix + v
+	a.e[0], err = a.newEnforcer(modelPath, d)
+	if err != nil {
+		return nil, err
 	}
-
-	for _, v := range a.e {
-		_, err = v.AddRolesForUser(a.userPrefix+user, roles)
-		if err != nil {
-			a.Sync()
-			return
-		}
+	if err = validateModel(a.e[0].GetModel()); err != nil {
+		return nil, err
 	}
+	// Writes go to the database in transactions, see commit
+	a.e[0].EnableAutoSave(false)
+	a.withEft = hasEffect(a.e[0])
+	a.withABAC, _ = hasABAC(a.e[0].GetModel())
+	a.withDataScope, _ = hasDataScope(a.e[0].GetModel())
 	return
 }
 
-func (a *AuthServer) DeleteRolesForUser(user string, roles []string) (err error) {
-	for k, v := range roles {
-		roles[k] = a.rolePrefix + v
-	}
+// AddRolesForUser grants the roles permanently, also the ones granted by
+// AddRolesForUserUntil before.
+func (a *AuthServer) AddRolesForUser(user string, roles []string) (err error) {
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+	return a.commitLockedWith(a.deleteExpiry(user, roles),
+		addOp("g", "g", a.userRoleRules(user, roles)))
+}
 
-	for _, v := range a.e {
-		for _, v1 := range roles {
-			_, err = v.DeleteRoleForUser(a.userPrefix+user, v1)
-			if err != nil {
-				a.Sync()
-				return
-			}
-		}
-	}
-	return
+func (a *AuthServer) DeleteRolesForUser(user string, roles []string) (err error) {
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+	return a.commitLockedWith(a.deleteExpiry(user, roles),
+		removeOp("g", "g", a.userRoleRules(user, roles)))
 }
 
 func (a *AuthServer) GetRolesForUser(user string) (roles []string, err error) {
 	user = a.userPrefix + user
-	roles, err = a.e[1].GetRolesForUser(user)
-	prefixLen := len(a.rolePrefix)
+	roles, err = a.reader().GetRolesForUser(user)
 	if err != nil {
 		roles, err = a.e[0].GetRolesForUser(user)
-		a.Sync()
-	}
-
-	for k, v := range roles {
-		roles[k] = v[prefixLen:]
+		a.requestSync()
 	}
+	roles = a.trimRoles(roles)
 	return
 }
 
 func (a *AuthServer) AddPoliciesForRole(role string, objs []string) (err error) {
-	var policies [][]string
-	for _, v := range objs {
-		policies = append(policies, []string{
-			a.rolePrefix + role,
-			a.policyPrefix + v,
-			a.action,
-		})
-	}
-	for _, v := range a.e {
-		_, err = v.AddPolicies(policies)
-		if err != nil {
-			a.Sync()
-			return
-		}
-	}
-	return
+	return a.AddPermissionsForRole(role, a.defaultPermissions(objs))
 }
 
 func (a *AuthServer) DeletePoliciesForRole(role string, objs []string) (err error) {
-	var policies [][]string
-	for _, v := range objs {
-		policies = append(policies, []string{
-			a.rolePrefix + role,
-			a.policyPrefix + v,
-			a.action,
-		})
+	return a.DeletePermissionsForRole(role, a.defaultPermissions(objs))
+}
+
+func (a *AuthServer) AddPermissionsForRole(role string,
+	perms []Permission) (err error) {
+
+	rules, err := a.rolePermissionRules(role, perms)
+	if err != nil {
+		return
 	}
-	for _, v := range a.e {
-		_, err = v.RemovePolicies(policies)
-		if err != nil {
-			a.Sync()
-			return
+	return a.commit(addOp("p", "p", rules))
+}
+
+func (a *AuthServer) DeletePermissionsForRole(role string,
+	perms []Permission) (err error) {
+
+	rules, err := a.rolePermissionRules(role, perms)
+	if err != nil {
+		return
+	}
+	return a.commit(removeOp("p", "p", rules))
+}
+
+func (a *AuthServer) GetPoliciesForRole(role string) (objs []string) {
+	for _, v := range a.GetPermissionsForRole(role) {
+		if v.Eft != EffectDeny {
+			objs = append(objs, v.Obj)
 		}
 	}
 	return
 }
 
-func (a *AuthServer) GetPoliciesForRole(role string) (objs []string) {
-	prefixLen := len(a.policyPrefix)
+func (a *AuthServer) GetPermissionsForRole(role string) (perms []Permission) {
 	role = a.rolePrefix + role
 
-	policies := a.e[1].GetFilteredPolicy(0, role)
+	policies := a.reader().GetFilteredPolicy(0, role)
 	if len(policies) == 0 {
 		policies = a.e[0].GetFilteredPolicy(0, role)
-		a.Sync()
-	}
-	for _, v := range policies {
-		objs = append(objs, v[1][prefixLen:])
+		// a role without policies is not a cache miss
+		if len(policies) != 0 {
+			a.requestSync()
+		}
 	}
-	return
+	return a.parsePermissions(policies)
 }
 
+// GetPoliciesForUser returns the allowed objects of the user's roles as
+// they are granted, patterns included, leaving out those denied by any of
+// the roles.
 func (a *AuthServer) GetPoliciesForUser(user string) (objs []string) {
+	for _, v := range permissionSet(a.GetPermissionsForUser(user)) {
+		objs = append(objs, v.Obj)
+	}
+
+	// the objects may be granted with several actions
+	return distinct(objs)
+}
+
+func (a *AuthServer) GetPermissionsForUser(user string) (perms []Permission) {
 	roles, err := a.GetRolesForUser(user)
 	if err != nil || len(roles) == 0 {
 		return
 	}
 
 	for _, v := range roles {
-		objs = append(objs, a.GetPoliciesForRole(v)...)
+		perms = append(perms, a.GetPermissionsForRole(v)...)
 	}
 
 	return
 }
 
 func (a *AuthServer) Enforce(user string, obj string) (b bool) {
-	user = a.userPrefix + user
-	obj = a.policyPrefix + obj
+	return a.EnforceAction(user, obj, a.action)
+}
 
-	b, err := a.e[1].Enforce(user, obj, a.action)
+func (a *AuthServer) EnforceAction(user string, obj string, act string) (b bool) {
+	sub := a.userPrefix + user
+
+	b, err := a.reader().Enforce(sub, a.policyPrefix+obj, act)
 	if err != nil {
-		b, _ = a.e[0].Enforce(user, obj, a.action)
-		return
+		b, err = a.e[0].Enforce(sub, a.policyPrefix+obj, act)
+	}
+	if err != nil || !(a.health.redisUp() || a.health.dbUp()) {
+		b = a.failMode.decide(b, err)
+	}
+	if !b {
+		a.auditor.recordDenial(user, obj, act)
+	}
+	return
+}
+
+func (a *AuthServer) userRoleRules(user string, roles []string) (rules [][]string) {
+	for _, v := range roles {
+		rules = append(rules, []string{a.userPrefix + user, a.rolePrefix + v})
+	}
+	return
+}
+
+func (a *AuthServer) rolePermissionRules(role string,
+	perms []Permission) (rules [][]string, err error) {
+
+	for _, v := range perms {
+		rule, err := permissionRule(
+			a.rolePrefix+role, a.policyPrefix+v.Obj, v, a.withEft)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func (a *AuthServer) defaultPermissions(objs []string) (perms []Permission) {
+	for _, v := range objs {
+		perms = append(perms, Permission{Obj: v, Act: a.action})
 	}
 	return
 }
@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+)
+
+const defaultReconcileInterval = 5 * time.Minute
+
+// SyncStats records what the synchronizations between the database
+// enforcer and the redis enforcer have done so far.
+type SyncStats struct {
+	Runs         int64
+	Failures     int64
+	Added        int64 // rules written to redis since start
+	Removed      int64 // rules deleted from redis since start
+	LastAdded    int
+	LastRemoved  int
+	LastDuration time.Duration
+	LastSyncAt   time.Time
+	LastErr      error
+	Pending      int // redis writes waiting in the outbox
+}
+
+type syncState struct {
+	// held by Sync and by the writes, so that a diff is never computed
+	// in the middle of a write.
+	mu       sync.Mutex
+	statsMu  sync.Mutex
+	stats    SyncStats
+	dirty    chan struct{}
+	interval chan time.Duration
+}
+
+// Sync makes the redis enforcer consistent with the database enforcer.
+// Only the rules which differ between them are added to or removed from
+// redis, the database is the source of truth.
+func (a *AuthServer) Sync() (err error) {
+	if a.readOnly {
+		return ErrReadOnly
+	}
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+
+	var added, removed int
+	start := time.Now()
+	defer func() {
+		if err == nil {
+			a.clearOutbox()
+		}
+		a.recordSync(start, added, removed, err)
+	}()
+
+	err = a.e[0].LoadPolicy()
+	a.health.reportDB(err)
+	if err != nil {
+		return
+	}
+	if !a.health.redisUp() {
+		return ErrRedisUnavailable
+	}
+	err = a.e[1].LoadPolicy()
+	a.health.reportRedis(err)
+	if err != nil {
+		return
+	}
+
+	m := a.e[0].GetModel()
+	for _, sec := range []string{"g", "p"} {
+		for ptype := range m[sec] {
+			add, remove := diffRules(
+				namedRules(a.e[0], sec, ptype),
+				namedRules(a.e[1], sec, ptype),
+			)
+			if len(remove) != 0 {
+				if err = removeNamedRules(a.e[1], sec, ptype, remove); err != nil {
+					return
+				}
+				removed += len(remove)
+			}
+			if len(add) != 0 {
+				if err = addNamedRules(a.e[1], sec, ptype, add); err != nil {
+					return
+				}
+				added += len(add)
+			}
+		}
+	}
+	return
+}
+
+// SyncStats returns a snapshot of the synchronization metrics.
+func (a *AuthServer) SyncStats() SyncStats {
+	a.syncer.statsMu.Lock()
+	stats := a.syncer.stats
+	a.syncer.statsMu.Unlock()
+
+	stats.Pending = a.pendingWrites()
+	return stats
+}
+
+// SetReconcileInterval changes how often the background loop synchronizes
+// redis with the database. A read-only server has no such loop.
+func (a *AuthServer) SetReconcileInterval(d time.Duration) {
+	if d <= 0 || a.readOnly || a.syncer.interval == nil {
+		return
+	}
+	a.syncer.interval <- d
+}
+
+func (a *AuthServer) startReconcile(d time.Duration) {
+	a.syncer.dirty = make(chan struct{}, 1)
+	a.syncer.interval = make(chan time.Duration)
+	go a.reconcile(d)
+}
+
+func (a *AuthServer) reconcile(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.syncer.dirty:
+		case <-ticker.C:
+		case d = <-a.syncer.interval:
+			ticker.Reset(d)
+			continue
+		}
+		// the failure is kept in SyncStats, the next round retries
+		_ = a.Sync()
+	}
+}
+
+// requestSync asks the background loop for a synchronization without
+// blocking the caller, pending requests are merged into one.
+func (a *AuthServer) requestSync() {
+	// the sync is requested again when redis recovers
+	if !a.health.redisUp() {
+		return
+	}
+	select {
+	case a.syncer.dirty <- struct{}{}:
+	default:
+	}
+}
+
+func (a *AuthServer) recordSync(start time.Time, added, removed int, err error) {
+	a.syncer.statsMu.Lock()
+	defer a.syncer.statsMu.Unlock()
+
+	st := &a.syncer.stats
+	st.Runs++
+	if err != nil {
+		st.Failures++
+	}
+	st.Added += int64(added)
+	st.Removed += int64(removed)
+	st.LastAdded = added
+	st.LastRemoved = removed
+	st.LastDuration = time.Since(start)
+	st.LastSyncAt = start
+	st.LastErr = err
+}
+
+// diffRules returns the rules of src missing in dst, and the rules of dst
+// missing in src.
+func diffRules(src, dst [][]string) (add, remove [][]string) {
+	srcSet := make(map[string]struct{}, len(src))
+	for _, v := range src {
+		srcSet[ruleKey(v)] = struct{}{}
+	}
+	dstSet := make(map[string]struct{}, len(dst))
+	for _, v := range dst {
+		dstSet[ruleKey(v)] = struct{}{}
+	}
+
+	for _, v := range src {
+		if _, ok := dstSet[ruleKey(v)]; !ok {
+			add = append(add, v)
+		}
+	}
+	for _, v := range dst {
+		if _, ok := srcSet[ruleKey(v)]; !ok {
+			remove = append(remove, v)
+		}
+	}
+	return
+}
+
+func ruleKey(rule []string) string {
+	return strings.Join(rule, "\x1f")
+}
+
+func namedRules(e *casbin.SyncedEnforcer, sec, ptype string) [][]string {
+	if sec == "g" {
+		return e.GetNamedGroupingPolicy(ptype)
+	}
+	return e.GetNamedPolicy(ptype)
+}
+
+func addNamedRules(e *casbin.SyncedEnforcer, sec, ptype string,
+	rules [][]string) (err error) {
+
+	if sec == "g" {
+		_, err = e.AddNamedGroupingPolicies(ptype, rules)
+		return
+	}
+	_, err = e.AddNamedPolicies(ptype, rules)
+	return
+}
+
+func removeNamedRules(e *casbin.SyncedEnforcer, sec, ptype string,
+	rules [][]string) (err error) {
+
+	if sec == "g" {
+		_, err = e.RemoveNamedGroupingPolicies(ptype, rules)
+		return
+	}
+	_, err = e.RemoveNamedPolicies(ptype, rules)
+	return
+}
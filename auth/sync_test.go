@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		src, dst    [][]string
+		add, remove [][]string
+	}{
+		{
+			name: "equal",
+			src:  [][]string{{"u_1", "r_admin"}, {"u_2", "r_staff"}},
+			dst:  [][]string{{"u_2", "r_staff"}, {"u_1", "r_admin"}},
+		},
+		{
+			name: "empty destination",
+			src:  [][]string{{"u_1", "r_admin"}},
+			add:  [][]string{{"u_1", "r_admin"}},
+		},
+		{
+			name:   "empty source",
+			dst:    [][]string{{"u_1", "r_admin"}},
+			remove: [][]string{{"u_1", "r_admin"}},
+		},
+		{
+			name:   "both ways",
+			src:    [][]string{{"r_admin", "p_user", "read", "allow"}, {"r_admin", "p_dept", "read", "allow"}},
+			dst:    [][]string{{"r_admin", "p_user", "read", "allow"}, {"r_admin", "p_user", "read", "deny"}},
+			add:    [][]string{{"r_admin", "p_dept", "read", "allow"}},
+			remove: [][]string{{"r_admin", "p_user", "read", "deny"}},
+		},
+		{
+			// the fields are not joined ambiguously
+			name:   "fields split differently",
+			src:    [][]string{{"u_1", "r_a,b"}},
+			dst:    [][]string{{"u_1,r_a", "b"}},
+			add:    [][]string{{"u_1", "r_a,b"}},
+			remove: [][]string{{"u_1,r_a", "b"}},
+		},
+		{
+			name:   "rule lengths",
+			src:    [][]string{{"r_admin", "p_user", "read"}},
+			dst:    [][]string{{"r_admin", "p_user", "read", "allow"}},
+			add:    [][]string{{"r_admin", "p_user", "read"}},
+			remove: [][]string{{"r_admin", "p_user", "read", "allow"}},
+		},
+	}
+	for _, v := range tests {
+		add, remove := diffRules(v.src, v.dst)
+		if !reflect.DeepEqual(add, v.add) || !reflect.DeepEqual(remove, v.remove) {
+			t.Errorf("%s: diffRules() = %v, %v, want %v, %v",
+				v.name, add, remove, v.add, v.remove)
+		}
+	}
+}
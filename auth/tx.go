@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	gormadapter "github.com/casbin/gorm-adapter/v3"
+	"gorm.io/gorm"
+)
+
+const (
+	outboxRetryInterval = 5 * time.Second
+	// beyond this many pending writes a full sync is cheaper than replaying
+	outboxMaxPending = 1000
+)
+
+// policyOp is one batch of rules to add to or remove from a policy type.
+type policyOp struct {
+	remove bool
+	sec    string
+	ptype  string
+	rules  [][]string
+}
+
+// outbox keeps the redis writes which failed after the database commit,
+// in the order they were committed.
+type outbox struct {
+	mu  sync.Mutex
+	ops []policyOp
+}
+
+func addOp(sec, ptype string, rules [][]string) policyOp {
+	return policyOp{sec: sec, ptype: ptype, rules: rules}
+}
+
+func removeOp(sec, ptype string, rules [][]string) policyOp {
+	return policyOp{remove: true, sec: sec, ptype: ptype, rules: rules}
+}
+
+// commit writes the operations to the database in one transaction, and
+// only after the commit applies them to the database enforcer and to
+// redis. Nothing changes when the transaction fails. When redis fails
+// the operations are queued in the outbox and retried in background.
+func (a *AuthServer) commit(ops ...policyOp) (err error) {
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+	return a.commitLocked(ops...)
+}
+
+// commitLocked is commit for callers which hold the lock already, because
+// they validate the operations against the current policies.
+func (a *AuthServer) commitLocked(ops ...policyOp) (err error) {
+	return a.commitLockedWith(nil, ops...)
+}
+
+// commitLockedWith runs extra in the same transaction, for the tables kept
+// next to the policies. The expiry changes it returns are audited together
+// with the rules.
+func (a *AuthServer) commitLockedWith(extra func(tx *gorm.DB) ([]ExpiryChange, error),
+	ops ...policyOp) (err error) {
+
+	if a.readOnly {
+		return ErrReadOnly
+	}
+	// 1. drop the repeated rules, what changes is read in the transaction
+	// since e[0] may miss the writes of the other servers
+	var requested []policyOp
+	for _, v := range ops {
+		v.rules = distinctRules(v.rules)
+		if len(v.rules) != 0 {
+			requested = append(requested, v)
+		}
+	}
+	if len(requested) == 0 && extra == nil {
+		return
+	}
+
+	// 2. write database
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		var expiries []ExpiryChange
+		if extra != nil {
+			var err error
+			if expiries, err = extra(tx); err != nil {
+				return err
+			}
+		}
+		changes, err := a.storedChanges(tx, requested)
+		if err != nil {
+			return err
+		}
+		if len(changes) != 0 || len(expiries) != 0 {
+			err := a.auditor.recordChange(tx, a.actor, changes, expiries)
+			if err != nil {
+				return err
+			}
+		}
+		adapter, err := gormadapter.NewFilteredAdapterByDB(tx, "", a.table)
+		if err != nil {
+			return err
+		}
+		for _, v := range changes {
+			if !v.remove {
+				if err = adapter.AddPolicies(v.sec, v.ptype, v.rules); err != nil {
+					return err
+				}
+				continue
+			}
+			// RemovePolicies of the adapter drops the errors of deleting
+			for _, v1 := range v.rules {
+				if err = adapter.RemovePolicy(v.sec, v.ptype, v1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// 3. update the database enforcer in memory
+	var changes []policyOp
+	for _, v := range requested {
+		v.rules = filterRules(a.e[0], v.sec, v.ptype, v.rules, v.remove)
+		if len(v.rules) != 0 {
+			changes = append(changes, v)
+		}
+	}
+	for _, v := range changes {
+		if v.remove {
+			_, err = a.e[0].SelfRemovePolicies(v.sec, v.ptype, v.rules)
+		} else {
+			_, err = a.e[0].SelfAddPolicies(v.sec, v.ptype, v.rules)
+		}
+		if err != nil {
+			// the database is committed, reloading it fixes the memory
+			err = nil
+			a.requestSync()
+			break
+		}
+	}
+
+	// 4. update redis
+	a.writeCache(changes)
+	return
+}
+
+// storedChanges returns the rules of the operations which the policy table
+// does not have yet, or still has for the removals.
+func (a *AuthServer) storedChanges(tx *gorm.DB,
+	ops []policyOp) (changes []policyOp, err error) {
+
+	for _, v := range ops {
+		subs := make([]string, 0, len(v.rules))
+		for _, v1 := range v.rules {
+			subs = append(subs, v1[0])
+		}
+		var lines []gormadapter.CasbinRule
+		err = tx.Table(a.table).
+			Where("ptype = ? AND v0 IN ?", v.ptype, distinct(subs)).
+			Find(&lines).Error
+		if err != nil {
+			return
+		}
+		stored := make(map[string]struct{}, len(lines))
+		for _, v1 := range lines {
+			stored[ruleKey(lineRule(v1))] = struct{}{}
+		}
+
+		var rules [][]string
+		for _, v1 := range v.rules {
+			if _, ok := stored[ruleKey(v1)]; ok == v.remove {
+				rules = append(rules, v1)
+			}
+		}
+		if len(rules) != 0 {
+			v.rules = rules
+			changes = append(changes, v)
+		}
+	}
+	return
+}
+
+// lineRule is the rule of a row, without the empty fields at the end as
+// the adapter loads it.
+func lineRule(line gormadapter.CasbinRule) []string {
+	rule := []string{line.V0, line.V1, line.V2, line.V3, line.V4, line.V5}
+	for len(rule) != 0 && rule[len(rule)-1] == "" {
+		rule = rule[:len(rule)-1]
+	}
+	return rule
+}
+
+func distinctRules(rules [][]string) (d [][]string) {
+	seen := make(map[string]struct{}, len(rules))
+	for _, v := range rules {
+		if _, ok := seen[ruleKey(v)]; !ok {
+			seen[ruleKey(v)] = struct{}{}
+			d = append(d, v)
+		}
+	}
+	return
+}
+
+// writeCache applies committed operations to redis. Operations are queued
+// behind the pending ones so that redis sees them in commit order.
+func (a *AuthServer) writeCache(ops []policyOp) {
+	a.outbox.mu.Lock()
+	defer a.outbox.mu.Unlock()
+
+	if len(a.outbox.ops) == 0 && a.health.redisUp() {
+		for len(ops) != 0 && a.applyCacheOp(ops[0]) == nil {
+			ops = ops[1:]
+		}
+	}
+	a.outbox.ops = append(a.outbox.ops, ops...)
+
+	if len(a.outbox.ops) > outboxMaxPending {
+		a.outbox.ops = nil
+		a.requestSync()
+	}
+}
+
+// flushOutbox retries the pending redis writes in order, and stops at the
+// first failure.
+func (a *AuthServer) flushOutbox() {
+	a.syncer.mu.Lock()
+	defer a.syncer.mu.Unlock()
+	a.outbox.mu.Lock()
+	defer a.outbox.mu.Unlock()
+
+	if !a.health.redisUp() {
+		return
+	}
+	for len(a.outbox.ops) != 0 && a.applyCacheOp(a.outbox.ops[0]) == nil {
+		a.outbox.ops = a.outbox.ops[1:]
+	}
+}
+
+// applyCacheOp writes the operation to redis, and counts its failure
+// towards opening the circuit.
+func (a *AuthServer) applyCacheOp(op policyOp) error {
+	err := applyOp(a.e[1], op)
+	a.health.reportRedis(err)
+	return err
+}
+
+// clearOutbox drops the pending writes once a sync has made redis equal
+// to the database.
+func (a *AuthServer) clearOutbox() {
+	a.outbox.mu.Lock()
+	defer a.outbox.mu.Unlock()
+	a.outbox.ops = nil
+}
+
+func (a *AuthServer) pendingWrites() int {
+	a.outbox.mu.Lock()
+	defer a.outbox.mu.Unlock()
+	return len(a.outbox.ops)
+}
+
+func (a *AuthServer) retryOutbox() {
+	ticker := time.NewTicker(outboxRetryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if a.pendingWrites() != 0 {
+			a.flushOutbox()
+		}
+	}
+}
+
+func applyOp(e *casbin.SyncedEnforcer, op policyOp) error {
+	rules := filterRules(e, op.sec, op.ptype, op.rules, op.remove)
+	if len(rules) == 0 {
+		return nil
+	}
+	if op.remove {
+		return removeNamedRules(e, op.sec, op.ptype, rules)
+	}
+	return addNamedRules(e, op.sec, op.ptype, rules)
+}
+
+// filterRules returns the distinct rules which the enforcer has when
+// present is true, or does not have when present is false.
+func filterRules(e *casbin.SyncedEnforcer, sec, ptype string,
+	rules [][]string, present bool) (filtered [][]string) {
+
+	seen := make(map[string]struct{}, len(rules))
+	for _, v := range rules {
+		key := ruleKey(v)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		var has bool
+		if sec == "g" {
+			has = e.HasNamedGroupingPolicy(ptype, v)
+		} else {
+			has = e.HasNamedPolicy(ptype, v)
+		}
+		if has == present {
+			filtered = append(filtered, v)
+		}
+	}
+	return
+}
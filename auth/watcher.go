@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/bytedance/sonic"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ persist.WatcherEx = new(policyWatcher)
+
+const policyChannel = "casbin:policy"
+
+// reloadMessage makes the receivers load all the policies again.
+var reloadMessage, _ = sonic.MarshalString(&policyMessage{Method: methodUpdate})
+
+const (
+	methodUpdate               = "Update"
+	methodAddPolicies          = "AddPolicies"
+	methodRemovePolicies       = "RemovePolicies"
+	methodRemoveFilteredPolicy = "RemoveFilteredPolicy"
+	methodSavePolicy           = "SavePolicy"
+)
+
+// policyMessage is published on every policy change, so that the other
+// instances can apply the change without reloading all the policies.
+type policyMessage struct {
+	Id          string     `json:"id"`
+	Method      string     `json:"method"`
+	Sec         string     `json:"sec,omitempty"`
+	Ptype       string     `json:"ptype,omitempty"`
+	Rules       [][]string `json:"rules,omitempty"`
+	FieldIndex  int        `json:"fieldIndex,omitempty"`
+	FieldValues []string   `json:"fieldValues,omitempty"`
+}
+
+// policyWatcher implements persist.WatcherEx by redis pub/sub.
+type policyWatcher struct {
+	id       string
+	channel  string
+	redis    *redis.Client
+	pubsub   *redis.PubSub
+	mu       sync.RWMutex
+	callback func(string)
+}
+
+func newPolicyWatcher(addr string, channel string) (*policyWatcher, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	w := &policyWatcher{
+		id:      hex.EncodeToString(id),
+		channel: channel,
+		redis:   redis.NewClient(&redis.Options{Addr: addr}),
+	}
+
+	// wait for the subscription to be confirmed
+	w.pubsub = w.redis.Subscribe(context.Background(), channel)
+	if _, err := w.pubsub.Receive(context.Background()); err != nil {
+		w.pubsub.Close()
+		w.redis.Close()
+		return nil, err
+	}
+	go w.subscribe()
+	return w, nil
+}
+
+func (w *policyWatcher) subscribe() {
+	for msg := range w.pubsub.ChannelWithSubscriptions() {
+		switch v := msg.(type) {
+		case *redis.Subscription:
+			// The subscription is confirmed again after redis reconnects,
+			// the changes published while disconnected are lost
+			if v.Kind == "subscribe" {
+				w.notify(reloadMessage)
+			}
+		case *redis.Message:
+			m := policyMessage{}
+			err := sonic.UnmarshalString(v.Payload, &m)
+			if err == nil && m.Id == w.id {
+				// changes made by this instance are applied already
+				continue
+			}
+			w.notify(v.Payload)
+		}
+	}
+}
+
+func (w *policyWatcher) notify(payload string) {
+	w.mu.RLock()
+	callback := w.callback
+	w.mu.RUnlock()
+	if callback != nil {
+		callback(payload)
+	}
+}
+
+func (w *policyWatcher) publish(m policyMessage) error {
+	m.Id = w.id
+	data, err := sonic.MarshalString(&m)
+	if err != nil {
+		return err
+	}
+	return w.redis.Publish(context.Background(), w.channel, data).Err()
+}
+
+func (w *policyWatcher) SetUpdateCallback(callback func(string)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.callback = callback
+	return nil
+}
+
+func (w *policyWatcher) Update() error {
+	return w.publish(policyMessage{Method: methodUpdate})
+}
+
+func (w *policyWatcher) Close() {
+	w.pubsub.Close()
+	w.redis.Close()
+}
+
+func (w *policyWatcher) UpdateForAddPolicy(sec, ptype string,
+	params ...string) error {
+
+	return w.UpdateForAddPolicies(sec, ptype, params)
+}
+
+func (w *policyWatcher) UpdateForRemovePolicy(sec, ptype string,
+	params ...string) error {
+
+	return w.UpdateForRemovePolicies(sec, ptype, params)
+}
+
+func (w *policyWatcher) UpdateForRemoveFilteredPolicy(sec, ptype string,
+	fieldIndex int, fieldValues ...string) error {
+
+	return w.publish(policyMessage{
+		Method:      methodRemoveFilteredPolicy,
+		Sec:         sec,
+		Ptype:       ptype,
+		FieldIndex:  fieldIndex,
+		FieldValues: fieldValues,
+	})
+}
+
+func (w *policyWatcher) UpdateForSavePolicy(model model.Model) error {
+	return w.publish(policyMessage{Method: methodSavePolicy})
+}
+
+func (w *policyWatcher) UpdateForAddPolicies(sec string, ptype string,
+	rules ...[]string) error {
+
+	return w.publish(policyMessage{
+		Method: methodAddPolicies,
+		Sec:    sec,
+		Ptype:  ptype,
+		Rules:  rules,
+	})
+}
+
+func (w *policyWatcher) UpdateForRemovePolicies(sec string, ptype string,
+	rules ...[]string) error {
+
+	return w.publish(policyMessage{
+		Method: methodRemovePolicies,
+		Sec:    sec,
+		Ptype:  ptype,
+		Rules:  rules,
+	})
+}
@@ -0,0 +1,138 @@
+// Command policy exports and imports the policies of auth.AuthServer.
+//
+//	policy -model rbac.conf -dsn "user:pass@tcp(127.0.0.1:3306)/db" \
+//		-table casbin_rule -redis 127.0.0.1:6379 export > policy.yaml
+//	policy ... -dry-run import < policy.yaml
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wheelergeo/g-otter-pkg/auth"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func main() {
+	modelPath := flag.String("model", "", "casbin model file, the default model if empty")
+	dsn := flag.String("dsn", "", "mysql dsn of the policy database")
+	table := flag.String("table", "casbin_rule", "policy table")
+	redis := flag.String("redis", "127.0.0.1:6379", "policy redis address")
+	format := flag.String("format", "yaml", "yaml or csv")
+	file := flag.String("file", "", "file to read or write, stdin or stdout by default")
+	dryRun := flag.Bool("dry-run", false, "import: print the diff only")
+	prune := flag.Bool("prune", false, "import: remove the policies missing in the file")
+	actor := flag.String("actor", "policy-cli", "import: actor recorded in the audit logs")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"usage: %s [flags] export|import\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cmd := flag.Arg(0)
+	if flag.NArg() != 1 || *dsn == "" || (cmd != "export" && cmd != "import") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(cmd, *modelPath, *dsn, *table, *redis,
+		auth.Format(*format), *file, *dryRun, *prune, *actor); err != nil {
+		fail(err)
+	}
+}
+
+// run returns the errors instead of exiting, so that the files are closed.
+func run(cmd string, modelPath string, dsn string, table string, redis string,
+	format auth.Format, file string, dryRun bool, prune bool, actor string) error {
+
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return err
+	}
+
+	// Export and dry runs only read the database
+	var server *auth.AuthServer
+	if cmd == "export" || dryRun {
+		if server, err = auth.NewReadOnlyServer(modelPath, db, table); err != nil {
+			return err
+		}
+	} else {
+		if server, err = newServer(modelPath, db, table, redis); err != nil {
+			return err
+		}
+		server = server.As(actor)
+	}
+
+	if cmd == "export" {
+		w := io.Writer(os.Stdout)
+		if file != "" {
+			f, err := os.Create(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return server.Export().Encode(w, format)
+	}
+
+	r := io.Reader(os.Stdin)
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	data, err := auth.DecodePolicyData(r, format)
+	if err != nil {
+		return err
+	}
+	diff, err := server.Import(data, auth.ImportOption{
+		DryRun: dryRun,
+		Prune:  prune,
+	})
+	if err != nil {
+		return err
+	}
+	printDiff(diff, format)
+	if dryRun {
+		return nil
+	}
+	// the command exits before the writes pending for redis are retried
+	return server.Sync()
+}
+
+// newServer returns the panics of auth.NewServer as errors.
+func newServer(modelPath string, db *gorm.DB, table string,
+	redis string) (server *auth.AuthServer, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	auth.NewServer(modelPath, db, table, redis)
+	return auth.Server(), nil
+}
+
+func printDiff(diff *auth.PolicyDiff, format auth.Format) {
+	if diff.Added.IsEmpty() && diff.Removed.IsEmpty() {
+		fmt.Fprintln(os.Stderr, "nothing to change")
+		return
+	}
+	fmt.Fprintln(os.Stderr, "+ added")
+	diff.Added.Encode(os.Stderr, format)
+	fmt.Fprintln(os.Stderr, "- removed")
+	diff.Removed.Encode(os.Stderr, format)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -8,6 +8,13 @@ const (
 
 	UpdateUserOnlineSuccess = 20010
 	UpdateUserOnlineFailed  = 20011
+
+	PermissionDenied = 20020
+	UnknownCaller    = 20021
+
+	AuthAdminSuccess    = 20030
+	AuthAdminBadRequest = 20031
+	AuthAdminFailed     = 20032
 )
 
 const (
@@ -18,4 +25,11 @@ const (
 
 	UpdateUserOnlineSuccessMsg = "更新用户在线成功"
 	UpdateUserOnlineFailedMsg  = "更新用户在线失败"
+
+	PermissionDeniedMsg = "没有访问权限"
+	UnknownCallerMsg    = "调用方身份未知"
+
+	AuthAdminSuccessMsg    = "操作成功"
+	AuthAdminBadRequestMsg = "请求参数错误"
+	AuthAdminFailedMsg     = "操作失败"
 )
@@ -5,6 +5,7 @@ go 1.20
 require (
 	aidanwoods.dev/go-paseto v1.5.1
 	github.com/alibaba/sentinel-golang v1.0.4
+	github.com/bytedance/gopkg v0.0.0-20230728082804-614d0af6619b
 	github.com/bytedance/sonic v1.10.2
 	github.com/casbin/casbin/v2 v2.81.0
 	github.com/casbin/gorm-adapter/v3 v3.20.0
@@ -13,6 +14,7 @@ require (
 	github.com/cloudwego/kitex v0.8.0
 	github.com/dlclark/regexp2 v1.10.0
 	github.com/elastic/go-elasticsearch/v8 v8.12.0
+	github.com/glebarez/sqlite v1.7.0
 	github.com/hertz-contrib/obs-opentelemetry/logging/logrus v0.1.1
 	github.com/kitex-contrib/obs-opentelemetry/logging/logrus v0.0.0-20240117073603-beff3185044c
 	github.com/mssola/user_agent v0.6.0
@@ -22,6 +24,8 @@ require (
 	golang.org/x/crypto v0.18.0
 	golang.org/x/text v0.14.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	gopkg.in/yaml.v2 v2.4.0
+	gorm.io/driver/mysql v1.4.1
 	gorm.io/gorm v1.25.5
 )
 
@@ -30,7 +34,6 @@ require (
 	github.com/StackExchange/wmi v0.0.0-20190523213315-cbe66965904d // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/bytedance/go-tagexpr/v2 v2.9.2 // indirect
-	github.com/bytedance/gopkg v0.0.0-20230728082804-614d0af6619b // indirect
 	github.com/casbin/govaluate v1.1.0 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/chenzhuoyu/base64x v0.0.0-20230717121745-296ad89f973d // indirect
@@ -41,7 +44,6 @@ require (
 	github.com/elastic/elastic-transport-go/v8 v8.4.0 // indirect
 	github.com/fsnotify/fsnotify v1.5.4 // indirect
 	github.com/glebarez/go-sqlite v1.20.3 // indirect
-	github.com/glebarez/sqlite v1.7.0 // indirect
 	github.com/go-logr/logr v1.3.0 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/go-ole/go-ole v1.2.4 // indirect
@@ -86,10 +88,10 @@ require (
 	go.opentelemetry.io/otel/trace v1.21.0 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
 	golang.org/x/arch v0.2.0 // indirect
+	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sys v0.16.0 // indirect
+	google.golang.org/genproto v0.0.0-20210513213006-bf773b8c8384 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gorm.io/driver/mysql v1.4.1 // indirect
 	gorm.io/driver/postgres v1.4.4 // indirect
 	gorm.io/driver/sqlserver v1.4.1 // indirect
 	gorm.io/plugin/dbresolver v1.3.0 // indirect
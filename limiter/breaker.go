@@ -0,0 +1,108 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/alibaba/sentinel-golang/core/base"
+	"github.com/alibaba/sentinel-golang/core/circuitbreaker"
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+const (
+	defaultStatIntervalMs = 1000
+	defaultRetryTimeoutMs = 5000
+)
+
+// Fallback answers the requests of a route blocked by the limiter, err
+// tells the rule, such as base.BlockTypeCircuitBreaking.
+type Fallback func(c context.Context, ctx *app.RequestContext, err *base.BlockError)
+
+var fallbacks sync.Map
+
+// SetFallback answers the blocked requests of the api, such as
+// GET:/api/v1/user, by f instead of the error of GenerateMiddleware, a nil
+// f removes it.
+func SetFallback(apiPath string, f Fallback) {
+	if f == nil {
+		fallbacks.Delete(apiPath)
+		return
+	}
+	fallbacks.Store(apiPath, f)
+}
+
+func getFallback(apiPath string) Fallback {
+	if f, ok := fallbacks.Load(apiPath); ok {
+		return f.(Fallback)
+	}
+	return nil
+}
+
+// breakerResource names the resource whose outcomes the breaker of the
+// api counts.
+func breakerResource(apiPath string) string {
+	return "breaker|" + apiPath
+}
+
+func breakerRule(rule LimiterRule) *circuitbreaker.Rule {
+	r := &circuitbreaker.Rule{
+		Resource:         breakerResource(rule.ApiPath),
+		RetryTimeoutMs:   rule.RetryTimeoutMs,
+		MinRequestAmount: rule.MinRequest,
+		StatIntervalMs:   rule.StatIntervalMs,
+		MaxAllowedRtMs:   rule.MaxRtMs,
+		Threshold:        rule.Threshold,
+	}
+	switch rule.Type {
+	case ErrorRatioBreaker:
+		r.Strategy = circuitbreaker.ErrorRatio
+	case ErrorCountBreaker:
+		r.Strategy = circuitbreaker.ErrorCount
+	case SlowRatioBreaker:
+		r.Strategy = circuitbreaker.SlowRequestRatio
+	}
+	if r.RetryTimeoutMs == 0 {
+		r.RetryTimeoutMs = defaultRetryTimeoutMs
+	}
+	if r.StatIntervalMs == 0 {
+		r.StatIntervalMs = defaultStatIntervalMs
+	}
+	return r
+}
+
+func breakerMWFunc(rule LimiterRule) MWFunc {
+	return func(c context.Context, ctx *app.RequestContext,
+		entries *Entries) *base.BlockError {
+
+		if rule.ApiPath != string(ctx.Method())+":"+ctx.FullPath() {
+			return nil
+		}
+		return entries.Entry(breakerResource(rule.ApiPath))
+	}
+}
+
+// outcome returns the error of the handled request, a status of 5xx or an
+// error added by ctx.Error.
+func outcome(ctx *app.RequestContext) error {
+	if err := ctx.Errors.Last(); err != nil {
+		return err
+	}
+	if status := ctx.Response.StatusCode(); status >= 500 {
+		return fmt.Errorf("status %d", status)
+	}
+	return nil
+}
+
+// tracePanic records a panic of the handlers and panics again.
+func tracePanic(entries *Entries) {
+	if r := recover(); r != nil {
+		err, ok := r.(error)
+		if !ok {
+			err = errors.New(fmt.Sprint(r))
+		}
+		entries.TraceError(err)
+		panic(r)
+	}
+}
@@ -0,0 +1,38 @@
+package limiter
+
+import (
+	sentinel "github.com/alibaba/sentinel-golang/api"
+	"github.com/alibaba/sentinel-golang/core/base"
+)
+
+// Entries are the sentinel entries passed by a request, which are exited
+// when the request is done, so that the concurrency is counted down.
+type Entries struct {
+	entries []*base.SentinelEntry
+}
+
+// Entry enters the resource, and keeps the entry for Exit when it passes.
+func (e *Entries) Entry(resource string, opts ...sentinel.EntryOption) *base.BlockError {
+	entry, err := sentinel.Entry(resource, opts...)
+	if err != nil {
+		return err
+	}
+	e.entries = append(e.entries, entry)
+	return nil
+}
+
+// TraceError records the error on the entries, so that the breakers count
+// the request as failed when the entries exit.
+func (e *Entries) TraceError(err error) {
+	for _, v := range e.entries {
+		sentinel.TraceError(v, err)
+	}
+}
+
+// Exit exits the entries in the reverse order of entering them.
+func (e *Entries) Exit() {
+	for i := len(e.entries) - 1; i >= 0; i-- {
+		e.entries[i].Exit()
+	}
+	e.entries = nil
+}
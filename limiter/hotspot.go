@@ -0,0 +1,150 @@
+package limiter
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	sentinel "github.com/alibaba/sentinel-golang/api"
+	"github.com/alibaba/sentinel-golang/core/base"
+	"github.com/alibaba/sentinel-golang/core/hotspot"
+	"github.com/bytedance/sonic"
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+// AnyValue in Query, Param, Header, Body or Cookie limits every distinct
+// value of the parameter separately, such as each userId to Qps.
+const AnyValue = "*"
+
+type paramSource string
+
+const (
+	fromQuery  paramSource = "query"
+	fromParam  paramSource = "param"
+	fromHeader paramSource = "header"
+	fromBody   paramSource = "body"
+	fromCookie paramSource = "cookie"
+)
+
+// paramMatcher picks the parameter of a request which a hotspot rule
+// limits, value is the only value limited or AnyValue.
+type paramMatcher struct {
+	source paramSource
+	name   string
+	value  string
+}
+
+func (m paramMatcher) extract(ctx *app.RequestContext) string {
+	switch m.source {
+	case fromQuery:
+		return ctx.Query(m.name)
+	case fromParam:
+		return ctx.Param(m.name)
+	case fromHeader:
+		return string(ctx.GetHeader(m.name))
+	case fromCookie:
+		return string(ctx.Cookie(m.name))
+	case fromBody:
+		path := make([]interface{}, 0, strings.Count(m.name, ".")+1)
+		for _, v := range strings.Split(m.name, ".") {
+			path = append(path, v)
+		}
+		node, err := sonic.Get(ctx.Request.Body(), path...)
+		if err != nil {
+			return ""
+		}
+		value, _ := node.String()
+		return value
+	}
+	return ""
+}
+
+// match returns the value of the parameter when the rule limits it.
+func (m paramMatcher) match(ctx *app.RequestContext) (value string, ok bool) {
+	value = m.extract(ctx)
+	if value == "" {
+		return
+	}
+	return value, m.value == AnyValue || m.value == value
+}
+
+// hotspotResource names the resource of a parameter of the api, so that
+// the same values of different parameters are counted apart.
+func hotspotResource(apiPath string, m paramMatcher) string {
+	return apiPath + "|" + string(m.source) + ":" + m.name
+}
+
+func hotspotMatchers(rule LimiterRule) (matchers []paramMatcher) {
+	for _, v := range []struct {
+		source paramSource
+		params map[string]string
+	}{
+		{fromQuery, rule.Query},
+		{fromParam, rule.Param},
+		{fromHeader, rule.Header},
+		{fromBody, rule.Body},
+		{fromCookie, rule.Cookie},
+	} {
+		for k, v1 := range v.params {
+			matchers = append(matchers, paramMatcher{source: v.source, name: k, value: v1})
+		}
+	}
+	sort.Slice(matchers, func(i, j int) bool {
+		return hotspotResource("", matchers[i]) < hotspotResource("", matchers[j])
+	})
+	return
+}
+
+func hotspotRules(rule LimiterRule) (rules []*hotspot.Rule) {
+	var specificItems map[interface{}]int64
+	if len(rule.SpecificItems) != 0 {
+		specificItems = make(map[interface{}]int64, len(rule.SpecificItems))
+		for k, v := range rule.SpecificItems {
+			specificItems[k] = v
+		}
+	}
+
+	for _, v := range hotspotMatchers(rule) {
+		r := &hotspot.Rule{
+			Resource:      hotspotResource(rule.ApiPath, v),
+			ParamIndex:    0,
+			SpecificItems: specificItems,
+			DurationInSec: 1,
+		}
+		if rule.Type == HotspotConcurrency {
+			r.MetricType = hotspot.Concurrency
+			r.Threshold = rule.Concurrency
+		} else {
+			r.MetricType = hotspot.QPS
+			r.Threshold = rule.Qps
+			r.BurstCount = rule.BurstCount
+		}
+		rules = append(rules, r)
+	}
+	return
+}
+
+func hotspotMWFunc(rule LimiterRule) MWFunc {
+	matchers := hotspotMatchers(rule)
+	return func(c context.Context, ctx *app.RequestContext,
+		entries *Entries) *base.BlockError {
+
+		if rule.ApiPath != string(ctx.Method())+":"+ctx.FullPath() {
+			return nil
+		}
+		for _, v := range matchers {
+			value, ok := v.match(ctx)
+			if !ok {
+				continue
+			}
+			err := entries.Entry(
+				hotspotResource(rule.ApiPath, v),
+				sentinel.WithArgs(value),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -6,15 +6,17 @@ import (
 
 	sentinel "github.com/alibaba/sentinel-golang/api"
 	"github.com/alibaba/sentinel-golang/core/base"
+	"github.com/alibaba/sentinel-golang/core/circuitbreaker"
 	"github.com/alibaba/sentinel-golang/core/flow"
 	"github.com/alibaba/sentinel-golang/core/hotspot"
+	"github.com/alibaba/sentinel-golang/core/isolation"
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/common/utils"
 )
 
 // Only for hertz
 type LimiteType int
-type MWFunc func(*app.RequestContext) *base.BlockError
+type MWFunc func(context.Context, *app.RequestContext, *Entries) *base.BlockError
 
 const (
 	GlobalFlow LimiteType = iota
@@ -22,83 +24,140 @@ const (
 	IpFlow
 	HotspotQPS
 	HotspotConcurrency
+	// Limits every user by the user of token.GetContext, or by the
+	// Authorization header before the token is parsed
+	UserFlow
+	// Limits the api, or all the apis when ApiPath is empty, across all
+	// the instances by redis, see InitRedis
+	DistributedFlow
+	// Limits the requests of the api being handled at the same time
+	ApiConcurrency
+	// Break the api for RetryTimeoutMs when the ratio, or the count, of the
+	// failed requests within StatIntervalMs exceeds Threshold. A request
+	// fails by a panic, a status of 5xx or an error added by ctx.Error.
+	ErrorRatioBreaker
+	ErrorCountBreaker
+	// Break the api when the ratio of the requests slower than MaxRtMs
+	// exceeds Threshold
+	SlowRatioBreaker
 )
 
 var once sync.Once
 
 type LimiterRule struct {
-	ApiPath     string // such as GET:/api/v1/user
-	Type        LimiteType
-	Concurrency int64             // for HotspotConcurrency
-	Qps         int64             // for *Flow and HotspotQPS
-	Param       map[string]string // for HotspotQPS and HotspotConcurrency
-	Query       map[string]string // for HotspotQPS and HotspotConcurrency
-	BurstCount  int64             // for HotspotQPS and IpFlow
+	ApiPath     string     `json:"apiPath,omitempty" yaml:"apiPath,omitempty"` // such as GET:/api/v1/user
+	Type        LimiteType `json:"type" yaml:"type"`
+	Concurrency int64      `json:"concurrency,omitempty" yaml:"concurrency,omitempty"` // for *Concurrency
+	Qps         int64      `json:"qps,omitempty" yaml:"qps,omitempty"`                 // for *Flow and HotspotQPS
+	// Parameters limited by HotspotQPS and HotspotConcurrency, by name and
+	// the value limited, or AnyValue for every value apart. Body is read
+	// as JSON, its names are paths such as user.id.
+	Param  map[string]string `json:"param,omitempty" yaml:"param,omitempty"`
+	Query  map[string]string `json:"query,omitempty" yaml:"query,omitempty"`
+	Header map[string]string `json:"header,omitempty" yaml:"header,omitempty"`
+	Body   map[string]string `json:"body,omitempty" yaml:"body,omitempty"`
+	Cookie map[string]string `json:"cookie,omitempty" yaml:"cookie,omitempty"`
+	// Thresholds of the values which differ from Qps or Concurrency, for
+	// HotspotQPS and HotspotConcurrency
+	SpecificItems map[string]int64 `json:"specificItems,omitempty" yaml:"specificItems,omitempty"`
+	BurstCount    int64            `json:"burstCount,omitempty" yaml:"burstCount,omitempty"` // for HotspotQPS, IpFlow and UserFlow
+	// Qps of the users having the role, for UserFlow. A user having
+	// several roles gets the highest Qps, the ApiPath of UserFlow may be
+	// empty for all the apis. The roles are told by SetRoleResolver.
+	RoleQps map[string]int64 `json:"roleQps,omitempty" yaml:"roleQps,omitempty"`
+	// Qps of every instance while redis is unreachable, for
+	// DistributedFlow, Qps by default
+	LocalQps int64 `json:"localQps,omitempty" yaml:"localQps,omitempty"`
+	// Ratio, or count for ErrorCountBreaker, above which the api breaks,
+	// for *Breaker
+	Threshold float64 `json:"threshold,omitempty" yaml:"threshold,omitempty"`
+	MaxRtMs   uint64  `json:"maxRtMs,omitempty" yaml:"maxRtMs,omitempty"` // for SlowRatioBreaker
+	// Requests needed within StatIntervalMs, 1000 by default, before the
+	// api breaks, and the time broken, 5000 by default, for *Breaker
+	MinRequest     uint64 `json:"minRequest,omitempty" yaml:"minRequest,omitempty"`
+	StatIntervalMs uint32 `json:"statIntervalMs,omitempty" yaml:"statIntervalMs,omitempty"`
+	RetryTimeoutMs uint32 `json:"retryTimeoutMs,omitempty" yaml:"retryTimeoutMs,omitempty"`
 }
 
 func GenerateMiddleware(errMsg string, errCode int,
 	rules []LimiterRule) app.HandlerFunc {
-	mwFuncs := initSentine(rules)
+	initSentine(rules)
+	abort := func(c context.Context, ctx *app.RequestContext, err *base.BlockError) {
+		if f := getFallback(string(ctx.Method()) + ":" + ctx.FullPath()); f != nil {
+			f(c, ctx, err)
+			ctx.Abort()
+			return
+		}
+		ctx.AbortWithStatusJSON(400, utils.H{
+			"err":  errMsg,
+			"code": errCode,
+		})
+	}
 	return func(c context.Context, ctx *app.RequestContext) {
-		_, err := sentinel.Entry("global")
+		// exited after the handlers, also when one of them panics
+		var entries Entries
+		defer entries.Exit()
+		defer tracePanic(&entries)
+
+		err := entries.Entry("global")
 		if err != nil {
-			ctx.AbortWithStatusJSON(400, utils.H{
-				"err":  errMsg,
-				"code": errCode,
-			})
+			abort(c, ctx, err)
 			return
 		}
 
-		_, err = sentinel.Entry(
+		err = entries.Entry(
 			"ip",
 			sentinel.WithArgs(ctx.ClientIP()),
 		)
 		if err != nil {
-			ctx.AbortWithStatusJSON(400, utils.H{
-				"err":  errMsg,
-				"code": errCode,
-			})
+			abort(c, ctx, err)
 			return
 		}
 
-		_, err = sentinel.Entry(string(ctx.Method()) + ":" + ctx.FullPath())
+		err = entries.Entry(string(ctx.Method()) + ":" + ctx.FullPath())
 		if err != nil {
-			ctx.AbortWithStatusJSON(400, utils.H{
-				"err":  errMsg,
-				"code": errCode,
-			})
+			abort(c, ctx, err)
 			return
 		}
 
-		for _, v := range mwFuncs {
-			err = v(ctx)
+		for _, v := range current.Load().mwFuncs {
+			err = v(c, ctx, &entries)
 			if err != nil {
-				ctx.AbortWithStatusJSON(400, utils.H{
-					"err":  errMsg,
-					"code": errCode,
-				})
+				abort(c, ctx, err)
 				return
 			}
 		}
 		ctx.Next(c)
+		entries.TraceError(outcome(ctx))
 	}
 }
 
-func initSentine(rules []LimiterRule) []MWFunc {
+func initSentine(rules []LimiterRule) {
 	once.Do(func() {
 		err := sentinel.InitDefault()
 		if err != nil {
 			panic(err)
 		}
 	})
+	if err := SetRules(rules); err != nil {
+		panic(err)
+	}
+}
 
-	var flowRules []*flow.Rule
-	var hotspotRules []*hotspot.Rule
-	var mwFuncs []MWFunc
+// buildRules converts the rules to the ones of sentinel and checks them
+// all, so that nothing is loaded when any of them is invalid.
+func buildRules(rules []LimiterRule) (set *ruleSet, err error) {
+	set = &ruleSet{rules: rules}
+	// entered after the other limits, so that the breakers only count the
+	// requests which are handled
+	var breakerFuncs []MWFunc
 	for _, v := range rules {
+		if err = validateRule(v); err != nil {
+			return nil, err
+		}
 		switch v.Type {
 		case GlobalFlow:
-			flowRules = append(flowRules, &flow.Rule{
+			set.flowRules = append(set.flowRules, &flow.Rule{
 				Resource:               "global",
 				Threshold:              float64(v.Qps),
 				TokenCalculateStrategy: flow.Direct,
@@ -106,7 +165,7 @@ func initSentine(rules []LimiterRule) []MWFunc {
 				StatIntervalInMs:       10000,
 			})
 		case ApiFlow:
-			flowRules = append(flowRules, &flow.Rule{
+			set.flowRules = append(set.flowRules, &flow.Rule{
 				Resource:               v.ApiPath,
 				Threshold:              float64(v.Qps),
 				TokenCalculateStrategy: flow.Direct,
@@ -114,7 +173,7 @@ func initSentine(rules []LimiterRule) []MWFunc {
 				StatIntervalInMs:       10000,
 			})
 		case IpFlow:
-			hotspotRules = append(hotspotRules, &hotspot.Rule{
+			set.hotspotRules = append(set.hotspotRules, &hotspot.Rule{
 				Resource:      "ip",
 				MetricType:    hotspot.QPS,
 				ParamIndex:    0,
@@ -122,87 +181,48 @@ func initSentine(rules []LimiterRule) []MWFunc {
 				Threshold:     v.Qps,
 				DurationInSec: 1,
 			})
-		case HotspotQPS:
-			hotspotRules = append(hotspotRules, &hotspot.Rule{
-				Resource:      v.ApiPath,
-				MetricType:    hotspot.QPS,
-				ParamIndex:    0,
-				BurstCount:    v.BurstCount,
-				Threshold:     v.Qps,
-				DurationInSec: 1,
+		case ApiConcurrency:
+			set.isolationRules = append(set.isolationRules, &isolation.Rule{
+				Resource:   v.ApiPath,
+				MetricType: isolation.Concurrency,
+				Threshold:  uint32(v.Concurrency),
 			})
-			for k1, v1 := range v.Query {
-				mwFuncs = append(mwFuncs,
-					func(ctx *app.RequestContext) (err *base.BlockError) {
-						if ctx.Query(k1) == v1 {
-							_, err = sentinel.Entry(
-								string(ctx.Method())+":"+ctx.FullPath(),
-								sentinel.WithArgs(v1),
-							)
-						}
-						return
-					})
-			}
-			for k1, v1 := range v.Param {
-				mwFuncs = append(mwFuncs,
-					func(ctx *app.RequestContext) (err *base.BlockError) {
-						if ctx.Param(k1) == v1 {
-							_, err = sentinel.Entry(
-								string(ctx.Method())+":"+ctx.FullPath(),
-								sentinel.WithArgs(v1),
-							)
-						}
-						return
-					})
-			}
-		case HotspotConcurrency:
-			hotspotRules = append(hotspotRules, &hotspot.Rule{
-				Resource:      v.ApiPath,
-				MetricType:    hotspot.Concurrency,
-				ParamIndex:    0,
-				Threshold:     v.Concurrency,
-				DurationInSec: 1,
-			})
-			for k1, v1 := range v.Query {
-				mwFuncs = append(mwFuncs,
-					func(ctx *app.RequestContext) (err *base.BlockError) {
-						if ctx.Query(k1) == v1 {
-							_, err = sentinel.Entry(
-								string(ctx.Method())+":"+ctx.FullPath(),
-								sentinel.WithArgs(v1),
-							)
-						}
-						return
-					})
-			}
-			for k1, v1 := range v.Param {
-				mwFuncs = append(mwFuncs,
-					func(ctx *app.RequestContext) (err *base.BlockError) {
-						if ctx.Param(k1) == v1 {
-							_, err = sentinel.Entry(
-								string(ctx.Method())+":"+ctx.FullPath(),
-								sentinel.WithArgs(v1),
-							)
-						}
-						return
-					})
-			}
+		case HotspotQPS, HotspotConcurrency:
+			set.hotspotRules = append(set.hotspotRules, hotspotRules(v)...)
+			set.mwFuncs = append(set.mwFuncs, hotspotMWFunc(v))
+		case UserFlow:
+			set.hotspotRules = append(set.hotspotRules, userRules(v)...)
+			set.mwFuncs = append(set.mwFuncs, userMWFunc(v))
+		case DistributedFlow:
+			set.flowRules = append(set.flowRules, distributedRule(v))
+			set.mwFuncs = append(set.mwFuncs, distributedMWFunc(v))
+		case ErrorRatioBreaker, ErrorCountBreaker, SlowRatioBreaker:
+			set.breakerRules = append(set.breakerRules, breakerRule(v))
+			breakerFuncs = append(breakerFuncs, breakerMWFunc(v))
 		default:
 			continue
 		}
 	}
-	if len(flowRules) != 0 {
-		_, err := flow.LoadRules(flowRules)
-		if err != nil {
-			panic(err)
+	set.mwFuncs = append(set.mwFuncs, breakerFuncs...)
+	for _, v := range set.flowRules {
+		if err = flow.IsValidRule(v); err != nil {
+			return nil, err
 		}
 	}
-
-	if len(hotspotRules) != 0 {
-		_, err := hotspot.LoadRules(hotspotRules)
-		if err != nil {
-			panic(err)
+	for _, v := range set.hotspotRules {
+		if err = hotspot.IsValidRule(v); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range set.isolationRules {
+		if err = isolation.IsValidRule(v); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range set.breakerRules {
+		if err = circuitbreaker.IsValidRule(v); err != nil {
+			return nil, err
 		}
 	}
-	return mwFuncs
+	return
 }
@@ -0,0 +1,123 @@
+package limiter
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/alibaba/sentinel-golang/core/base"
+	"github.com/alibaba/sentinel-golang/core/flow"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisTimeout = 50 * time.Millisecond
+	// how long the local limits are used after redis fails
+	redisRetryAfter = 5 * time.Second
+)
+
+// gcraScript limits by the generic cell rate algorithm, the key stores the
+// theoretical arrival time of the next request. It returns 1 when the
+// request is allowed.
+var gcraScript = redis.NewScript(`
+local key = KEYS[1]
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+
+local interval = 1 / rate
+local burst_offset = interval * burst
+
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = (t[1] - 1483228800) + t[2] / 1000000
+
+local tat = tonumber(redis.call("GET", key))
+if not tat or tat < now then
+	tat = now
+end
+
+local new_tat = tat + interval
+if new_tat - burst_offset > now then
+	return 0
+end
+redis.call("SET", key, new_tat, "EX", math.ceil(new_tat - now))
+return 1
+`)
+
+type redisLimiter struct {
+	client *redis.Client
+	prefix string
+	// unix nano until which redis is not tried again
+	downUntil atomic.Int64
+}
+
+var rl *redisLimiter
+
+// InitRedis enables DistributedFlow, the keys are written under the prefix.
+func InitRedis(client *redis.Client, prefix string) {
+	rl = &redisLimiter{client: client, prefix: prefix}
+}
+
+// distributedResource names the local resource used while redis is down.
+func distributedResource(apiPath string) string {
+	return "dist|" + apiPath
+}
+
+// allow reports whether the cluster allows the request on the api, ok is
+// false when redis cannot tell.
+func (l *redisLimiter) allow(apiPath string, qps int64, burst int64) (allowed bool, ok bool) {
+	if l == nil || time.Now().UnixNano() < l.downUntil.Load() {
+		return
+	}
+	if burst <= 0 {
+		burst = qps
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	res, err := gcraScript.Run(ctx, l.client, []string{l.prefix + ":" + apiPath},
+		strconv.FormatInt(burst, 10), strconv.FormatInt(qps, 10)).Int()
+	if err != nil {
+		l.downUntil.Store(time.Now().Add(redisRetryAfter).UnixNano())
+		return
+	}
+	return res == 1, true
+}
+
+func distributedRule(rule LimiterRule) *flow.Rule {
+	qps := rule.LocalQps
+	if qps <= 0 {
+		qps = rule.Qps
+	}
+	return &flow.Rule{
+		Resource:               distributedResource(rule.ApiPath),
+		Threshold:              float64(qps),
+		TokenCalculateStrategy: flow.Direct,
+		ControlBehavior:        flow.Reject,
+		StatIntervalInMs:       1000,
+	}
+}
+
+func distributedMWFunc(rule LimiterRule) MWFunc {
+	return func(c context.Context, ctx *app.RequestContext,
+		entries *Entries) (err *base.BlockError) {
+
+		if rule.ApiPath != "" && rule.ApiPath != string(ctx.Method())+":"+ctx.FullPath() {
+			return
+		}
+		allowed, ok := rl.allow(rule.ApiPath, rule.Qps, rule.BurstCount)
+		if !ok {
+			err = entries.Entry(distributedResource(rule.ApiPath))
+			return
+		}
+		if !allowed {
+			err = base.NewBlockError(
+				base.WithBlockType(base.BlockTypeFlow),
+				base.WithBlockMsg("distributed flow limit"),
+			)
+		}
+		return
+	}
+}
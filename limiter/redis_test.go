@@ -0,0 +1,38 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisLimiterFallback(t *testing.T) {
+	var nilLimiter *redisLimiter
+	if _, ok := nilLimiter.allow("GET:/api/v1/user", 10, 0); ok {
+		t.Error("allow() decided without InitRedis")
+	}
+
+	l := &redisLimiter{
+		client: redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1}),
+		prefix: "limiter",
+	}
+	defer l.client.Close()
+	if _, ok := l.allow("GET:/api/v1/user", 10, 0); ok {
+		t.Fatal("allow() decided without redis")
+	}
+	if until := time.Unix(0, l.downUntil.Load()); time.Until(until) <= 0 {
+		t.Errorf("redis is retried at once after a failure, until %v", until)
+	}
+}
+
+func TestDistributedRule(t *testing.T) {
+	rule := distributedRule(LimiterRule{Type: DistributedFlow, ApiPath: "GET:/x", Qps: 100})
+	if rule.Threshold != 100 || rule.Resource != distributedResource("GET:/x") {
+		t.Errorf("distributedRule() = %v, want the qps of the cluster", rule)
+	}
+	rule = distributedRule(LimiterRule{Type: DistributedFlow, ApiPath: "GET:/x", Qps: 100, LocalQps: 20})
+	if rule.Threshold != 20 {
+		t.Errorf("distributedRule() = %v, want the local qps", rule)
+	}
+}
@@ -0,0 +1,365 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alibaba/sentinel-golang/core/circuitbreaker"
+	"github.com/alibaba/sentinel-golang/core/flow"
+	"github.com/alibaba/sentinel-golang/core/hotspot"
+	"github.com/alibaba/sentinel-golang/core/isolation"
+	"github.com/bytedance/sonic"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v2"
+)
+
+var limiteTypeNames = []string{
+	GlobalFlow:         "GlobalFlow",
+	ApiFlow:            "ApiFlow",
+	IpFlow:             "IpFlow",
+	HotspotQPS:         "HotspotQPS",
+	HotspotConcurrency: "HotspotConcurrency",
+	UserFlow:           "UserFlow",
+	DistributedFlow:    "DistributedFlow",
+	ApiConcurrency:     "ApiConcurrency",
+	ErrorRatioBreaker:  "ErrorRatioBreaker",
+	ErrorCountBreaker:  "ErrorCountBreaker",
+	SlowRatioBreaker:   "SlowRatioBreaker",
+}
+
+func (t LimiteType) String() string {
+	if t < 0 || int(t) >= len(limiteTypeNames) {
+		return fmt.Sprintf("LimiteType(%d)", int(t))
+	}
+	return limiteTypeNames[t]
+}
+
+// MarshalText writes the type by name in the rule files.
+func (t LimiteType) MarshalText() ([]byte, error) {
+	if t < 0 || int(t) >= len(limiteTypeNames) {
+		return nil, fmt.Errorf("unknown limiter type %d", int(t))
+	}
+	return []byte(limiteTypeNames[t]), nil
+}
+
+func (t *LimiteType) UnmarshalText(text []byte) error {
+	for k, v := range limiteTypeNames {
+		if v == string(text) {
+			*t = LimiteType(k)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown limiter type %q", text)
+}
+
+// ruleSet is the rules in use, it is replaced as a whole so that a request
+// never sees the match functions of two versions.
+type ruleSet struct {
+	rules          []LimiterRule
+	flowRules      []*flow.Rule
+	hotspotRules   []*hotspot.Rule
+	isolationRules []*isolation.Rule
+	breakerRules   []*circuitbreaker.Rule
+	mwFuncs        []MWFunc
+}
+
+var (
+	current atomic.Pointer[ruleSet]
+	// held by the changes of the rules
+	rulesMu sync.Mutex
+)
+
+func init() {
+	current.Store(&ruleSet{})
+}
+
+// SetRules replaces all the rules, nothing changes when any of them is
+// invalid.
+func SetRules(rules []LimiterRule) error {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	return setRulesLocked(rules)
+}
+
+// AddRules adds the rules, replacing the ones of the same type and api.
+func AddRules(rules ...LimiterRule) error {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	replaced := make(map[string]struct{}, len(rules))
+	for _, v := range rules {
+		replaced[ruleKey(v)] = struct{}{}
+	}
+	var merged []LimiterRule
+	for _, v := range current.Load().rules {
+		if _, ok := replaced[ruleKey(v)]; !ok {
+			merged = append(merged, v)
+		}
+	}
+	return setRulesLocked(append(merged, rules...))
+}
+
+// RemoveRules removes the rules of the same type and api as the given ones.
+func RemoveRules(rules ...LimiterRule) error {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	removed := make(map[string]struct{}, len(rules))
+	for _, v := range rules {
+		removed[ruleKey(v)] = struct{}{}
+	}
+	var left []LimiterRule
+	for _, v := range current.Load().rules {
+		if _, ok := removed[ruleKey(v)]; !ok {
+			left = append(left, v)
+		}
+	}
+	return setRulesLocked(left)
+}
+
+// Rules returns the rules in use.
+func Rules() []LimiterRule {
+	return append([]LimiterRule(nil), current.Load().rules...)
+}
+
+func setRulesLocked(rules []LimiterRule) error {
+	set, err := buildRules(rules)
+	if err != nil {
+		return err
+	}
+	old := current.Load()
+	if err = set.load(); err != nil {
+		// put back the rules of sentinel which may be half loaded
+		_ = old.load()
+		return err
+	}
+	current.Store(set)
+	return nil
+}
+
+func (s *ruleSet) load() error {
+	if _, err := flow.LoadRules(s.flowRules); err != nil {
+		return err
+	}
+	if _, err := hotspot.LoadRules(s.hotspotRules); err != nil {
+		return err
+	}
+	if _, err := isolation.LoadRules(s.isolationRules); err != nil {
+		return err
+	}
+	_, err := circuitbreaker.LoadRules(s.breakerRules)
+	return err
+}
+
+// ruleKey identifies a rule for AddRules and RemoveRules.
+func ruleKey(rule LimiterRule) string {
+	switch rule.Type {
+	case GlobalFlow, IpFlow:
+		return rule.Type.String()
+	}
+	return rule.Type.String() + "|" + rule.ApiPath
+}
+
+func validateRule(rule LimiterRule) error {
+	if rule.Type < 0 || int(rule.Type) >= len(limiteTypeNames) {
+		return fmt.Errorf("unknown limiter type %d", int(rule.Type))
+	}
+
+	switch rule.Type {
+	case ApiFlow, ApiConcurrency, HotspotQPS, HotspotConcurrency,
+		ErrorRatioBreaker, ErrorCountBreaker, SlowRatioBreaker:
+		if rule.ApiPath == "" {
+			return fmt.Errorf("%s: api path must not be empty", rule.Type)
+		}
+	}
+	switch rule.Type {
+	case HotspotQPS, HotspotConcurrency:
+		if len(hotspotMatchers(rule)) == 0 {
+			return fmt.Errorf("%s %s: no parameter is limited", rule.Type, rule.ApiPath)
+		}
+	}
+	for k, v := range rule.SpecificItems {
+		if v < 0 {
+			return fmt.Errorf("%s %s: threshold of %s must not be negative",
+				rule.Type, rule.ApiPath, k)
+		}
+	}
+	switch rule.Type {
+	case ErrorRatioBreaker, ErrorCountBreaker, SlowRatioBreaker:
+		if rule.Threshold <= 0 {
+			return fmt.Errorf("%s %s: threshold must be positive", rule.Type, rule.ApiPath)
+		}
+		if rule.Type == SlowRatioBreaker && rule.MaxRtMs == 0 {
+			return fmt.Errorf("%s %s: max rt must be positive", rule.Type, rule.ApiPath)
+		}
+	case HotspotConcurrency, ApiConcurrency:
+		if rule.Concurrency <= 0 {
+			return fmt.Errorf("%s %s: concurrency must be positive", rule.Type, rule.ApiPath)
+		}
+	case DistributedFlow:
+		// the interval of the requests is 1 / qps
+		if rule.Qps <= 0 {
+			return fmt.Errorf("%s %s: qps must be positive", rule.Type, rule.ApiPath)
+		}
+	default:
+		// a qps of 0 blocks the requests
+		if rule.Qps < 0 {
+			return fmt.Errorf("%s %s: qps must not be negative", rule.Type, rule.ApiPath)
+		}
+	}
+	if rule.BurstCount < 0 || rule.LocalQps < 0 {
+		return fmt.Errorf("%s %s: burst and local qps must not be negative",
+			rule.Type, rule.ApiPath)
+	}
+	for k, v := range rule.RoleQps {
+		if v <= 0 {
+			return fmt.Errorf("%s %s: qps of role %s must be positive",
+				rule.Type, rule.ApiPath, k)
+		}
+	}
+	return nil
+}
+
+// DecodeRules reads the rules as JSON, or as YAML when isYAML is true.
+func DecodeRules(data []byte, isYAML bool) (rules []LimiterRule, err error) {
+	if isYAML {
+		err = yaml.Unmarshal(data, &rules)
+	} else {
+		err = sonic.Unmarshal(data, &rules)
+	}
+	return
+}
+
+// defaultWatchInterval is the interval of WatchFile when it is not given.
+const defaultWatchInterval = 5 * time.Second
+
+// WatchFile loads the rules of the file, as YAML unless its extension is
+// .json, and loads them again whenever the file is modified, checking it
+// every interval, or every defaultWatchInterval when it is not positive.
+// The errors of reading and loading go to onErr, the rules in use are kept
+// then.
+func WatchFile(path string, interval time.Duration, onErr func(error)) (stop func()) {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	isYAML := filepath.Ext(path) != ".json"
+	var modTime time.Time
+	reload := func() {
+		info, err := os.Stat(path)
+		if err != nil {
+			report(onErr, err)
+			return
+		}
+		if info.ModTime().Equal(modTime) {
+			return
+		}
+		modTime = info.ModTime()
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			report(onErr, err)
+			return
+		}
+		rules, err := DecodeRules(data, isYAML)
+		if err == nil {
+			err = SetRules(rules)
+		}
+		report(onErr, err)
+	}
+
+	reload()
+	return poll(interval, reload)
+}
+
+// WatchRedis loads the rules stored as JSON at the key, and loads them
+// again whenever a message is published on the channel of the same name,
+// see PublishRules. It fails when the channel cannot be subscribed.
+func WatchRedis(client *redis.Client, key string,
+	onErr func(error)) (stop func(), err error) {
+
+	reload := func() {
+		data, err := client.Get(context.Background(), key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return
+		}
+		if err == nil {
+			var rules []LimiterRule
+			if rules, err = DecodeRules(data, false); err == nil {
+				err = SetRules(rules)
+			}
+		}
+		report(onErr, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pubsub := client.Subscribe(ctx, key)
+	// subscribe before loading, so that no change is missed
+	if _, err = pubsub.Receive(ctx); err != nil {
+		cancel()
+		pubsub.Close()
+		return nil, err
+	}
+	reload()
+
+	go func() {
+		// a subscription is confirmed again after redis reconnects, the
+		// changes published while disconnected are lost
+		for range pubsub.ChannelWithSubscriptions() {
+			reload()
+		}
+	}()
+	return func() {
+		cancel()
+		pubsub.Close()
+	}, nil
+}
+
+// PublishRules stores the rules at the key and notifies WatchRedis of every
+// instance, the rules are checked before.
+func PublishRules(ctx context.Context, client *redis.Client, key string,
+	rules []LimiterRule) error {
+
+	if _, err := buildRules(rules); err != nil {
+		return err
+	}
+	data, err := sonic.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	if err = client.Set(ctx, key, data, 0).Err(); err != nil {
+		return err
+	}
+	return client.Publish(ctx, key, "reload").Err()
+}
+
+func poll(interval time.Duration, f func()) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var stopOnce sync.Once
+	return func() {
+		stopOnce.Do(func() { close(done) })
+	}
+}
+
+func report(onErr func(error), err error) {
+	if err != nil && onErr != nil {
+		onErr(err)
+	}
+}
@@ -0,0 +1,115 @@
+package limiter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+
+	sentinel "github.com/alibaba/sentinel-golang/api"
+	"github.com/alibaba/sentinel-golang/core/base"
+	"github.com/alibaba/sentinel-golang/core/hotspot"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/wheelergeo/g-otter-pkg/token"
+)
+
+// userResource names the resource limiting the users of a role on the api,
+// the empty api is every api and the empty role is the default quota.
+func userResource(apiPath string, role string) string {
+	return "user|" + apiPath + "|" + role
+}
+
+// userKey identifies the caller by the user of token.GetContext, or by the
+// hash of the Authorization header before the token is parsed. It is empty
+// for the anonymous requests.
+func userKey(c context.Context, ctx *app.RequestContext) string {
+	if userCtx := token.GetContext(c).UserCtx; userCtx != nil {
+		return "u:" + strconv.FormatInt(userCtx.Id, 10)
+	}
+	authorization := ctx.GetHeader("Authorization")
+	if len(authorization) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(authorization)
+	return "t:" + hex.EncodeToString(sum[:16])
+}
+
+// RoleResolver returns the roles of the user of the request, the inherited
+// ones included.
+type RoleResolver func(c context.Context) []string
+
+var roleResolver atomic.Pointer[RoleResolver]
+
+// SetRoleResolver tells the roles of the users for RoleQps of UserFlow, a
+// nil f removes it and every user gets the default quota. With auth, such as
+//
+//	limiter.SetRoleResolver(func(c context.Context) []string {
+//		id := strconv.FormatInt(token.GetContext(c).UserCtx.Id, 10)
+//		roles, _ := auth.Client().GetImplicitRolesForUser(id)
+//		return roles
+//	})
+func SetRoleResolver(f RoleResolver) {
+	if f == nil {
+		roleResolver.Store(nil)
+		return
+	}
+	roleResolver.Store(&f)
+}
+
+// userRole returns the role of the user with the highest quota in
+// RoleQps, and the empty role for the default quota.
+func userRole(c context.Context, rule LimiterRule) string {
+	resolve := roleResolver.Load()
+	if len(rule.RoleQps) == 0 || token.GetContext(c).UserCtx == nil ||
+		resolve == nil {
+		return ""
+	}
+	roles := (*resolve)(c)
+
+	role, qps := "", rule.Qps
+	for _, v := range roles {
+		if q, ok := rule.RoleQps[v]; ok && q > qps {
+			role, qps = v, q
+		}
+	}
+	return role
+}
+
+func userRules(rule LimiterRule) (rules []*hotspot.Rule) {
+	newRule := func(role string, qps int64) *hotspot.Rule {
+		return &hotspot.Rule{
+			Resource:      userResource(rule.ApiPath, role),
+			MetricType:    hotspot.QPS,
+			ParamIndex:    0,
+			BurstCount:    rule.BurstCount,
+			Threshold:     qps,
+			DurationInSec: 1,
+		}
+	}
+
+	rules = append(rules, newRule("", rule.Qps))
+	for k, v := range rule.RoleQps {
+		rules = append(rules, newRule(k, v))
+	}
+	return
+}
+
+func userMWFunc(rule LimiterRule) MWFunc {
+	return func(c context.Context, ctx *app.RequestContext,
+		entries *Entries) (err *base.BlockError) {
+
+		if rule.ApiPath != "" && rule.ApiPath != string(ctx.Method())+":"+ctx.FullPath() {
+			return
+		}
+		key := userKey(c, ctx)
+		if key == "" {
+			return
+		}
+		err = entries.Entry(
+			userResource(rule.ApiPath, userRole(c, rule)),
+			sentinel.WithArgs(key),
+		)
+		return
+	}
+}